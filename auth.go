@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores anything after 72 bytes
+	maxPasswordLength = 72
+)
+
+var (
+	ErrInvalidLogin   = errors.New("incorrect username or password")
+	ErrUsernameTaken  = errors.New("that username is already taken")
+	ErrNoUsername     = errors.New("a username is needed to log in with")
+	ErrPasswordLength = fmt.Errorf("passwords must be between %d and %d characters", minPasswordLength, maxPasswordLength)
+	ErrAlreadySetUp   = errors.New("an admin has already been set up")
+
+	// usersMu is held while adding users or changing usernames, so that
+	// usernames stay unique
+	usersMu sync.Mutex
+
+	// dummyHash is checked against when a username isn't found, so that
+	// logging in takes as long whether or not the username exists
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-password"), bcrypt.DefaultCost)
+
+	// publicPaths can be used without logging in
+	publicPaths = map[string]bool{
+		"/login":               true,
+		"/login/oidc":          true,
+		"/login/oidc/callback": true,
+		"/logout":              true,
+		"/setup":               true,
+		"/join":                true,
+		"/health":              true,
+		"/ready":               true,
+	}
+)
+
+// hashPassword checks a new password is an acceptable length, and hashes it
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", ErrPasswordLength
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// findUser returns the first user matching, if any
+func findUser(match func(user *User) bool) (*User, bool) {
+	for _, user := range store.Users() {
+		if match(&user) {
+			return &user, true
+		}
+	}
+	return nil, false
+}
+
+func userByUsername(username string) (*User, bool) {
+	if username == "" {
+		return nil, false
+	}
+	return findUser(func(user *User) bool {
+		return strings.EqualFold(user.Username, username)
+	})
+}
+
+// checkUsernameFree returns an error if a user other than id has the username.
+// The caller must hold usersMu.
+func checkUsernameFree(username string, id string) error {
+	if user, ok := userByUsername(username); ok && user.ID != id {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// checkPassword returns the user with the username, if the password is theirs
+func checkPassword(username, password string) (*User, error) {
+	user, ok := userByUsername(username)
+	if !ok || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidLogin
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidLogin
+	}
+	return user, nil
+}
+
+// setupAdmin adds the first user, as the admin of a new household. It fails
+// once anyone has been set up, after which people join by invite. The user is
+// given a password if one is passed, otherwise they log in some other way.
+func setupAdmin(login User, password string) (*User, error) {
+	var hash string
+	if password != "" {
+		var err error
+		hash, err = hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	if len(store.Users()) > 0 {
+		return nil, ErrAlreadySetUp
+	}
+	login.ID = newID()
+	login.Role = RoleAdmin
+	login.HouseholdID = newID()
+	login.PasswordHash = hash
+	login.Created = time.Now()
+	if err := store.PutUser(&login); err != nil {
+		return nil, fmt.Errorf("failed to save user: %w", err)
+	}
+	return &login, nil
+}
+
+// changeLogin sets the username and password a user logs in with. If they
+// already have a password, it must be given as current.
+func changeLogin(user *User, username, current, password string) error {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return ErrNoUsername
+	}
+	if user.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current)) != nil {
+		return ErrInvalidLogin
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	if err := checkUsernameFree(username, user.ID); err != nil {
+		return err
+	}
+	user.Username = username
+	user.PasswordHash = hash
+	return store.PutUser(user)
+}
+
+// proxyUsername returns the username set by a trusted reverse proxy in the
+// AUTH_PROXY_HEADER header, if enabled. Requests not from one of the
+// TRUSTED_PROXIES are ignored, so the header can't be forged.
+func proxyUsername(r *http.Request) (string, bool) {
+	if proxyAuthHeader == "" {
+		return "", false
+	}
+	username := strings.TrimSpace(r.Header.Get(proxyAuthHeader))
+	if username == "" {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return username, true
+		}
+	}
+	log.Printf("Ignoring %s header from untrusted address %s", proxyAuthHeader, r.RemoteAddr)
+	return "", false
+}
+
+// parseCIDRs parses a comma separated list of networks. Single addresses are
+// treated as a network of one.
+func parseCIDRs(value string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q: %s", field, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// signIn sets the user in the cookie
+func signIn(w http.ResponseWriter, data map[string]string, user *User) error {
+	delete(data, refreshTokenKey)
+	delete(data, authorizationCodeKey)
+	// Forms from before logging in shouldn't work for the new login
+	delete(data, csrfKey)
+	data[userKey] = user.ID
+	return setCookie(data, w)
+}
+
+// setRequestCookie replaces the cookie in the request, so that handlers see
+// changes made to it earlier in the request
+func setRequestCookie(r *http.Request, data map[string]string) error {
+	encoded, err := securecookie.EncodeMulti(COOKIE_NAME, data, cookieCodecs...)
+	if err != nil {
+		return err
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != COOKIE_NAME {
+			r.AddCookie(cookie)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: COOKIE_NAME, Value: encoded})
+	return nil
+}
+
+// requireLogin redirects anyone who hasn't logged in to the login page, other
+// than for publicPaths. Users signed in by a trusted reverse proxy are logged
+// in as the user with the same username.
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, err := getCookie(r)
+		if err != nil {
+			log.Printf("Unable to get cookie: %s\n", err.Error())
+			data = make(map[string]string)
+		}
+		previous := data[userKey]
+		user, ok := userFromCookie(w, data)
+		if username, fromProxy := proxyUsername(r); fromProxy {
+			proxied, found := userByUsername(username)
+			if !found {
+				// The first person through the proxy sets up the app
+				proxied, err = setupAdmin(User{Name: username, Username: username}, "")
+				found = err == nil
+			}
+			ok = found
+			if found && (user == nil || user.ID != proxied.ID) {
+				user = proxied
+				if err := signIn(w, data, user); err != nil {
+					log.Printf("Failed to set cookie: %s", err)
+				}
+			}
+		}
+		if !ok {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if data[userKey] != previous {
+			if err := setRequestCookie(r, data); err != nil {
+				log.Printf("Failed to update request cookie: %s", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safeNext returns where to go after logging in, only allowing paths on this
+// server
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func renderAuthPage(w http.ResponseWriter, r *http.Request, name string, values map[string]interface{}) {
+	files := []string{
+		"./templates/base.tmpl",
+		"./templates/" + name + ".tmpl",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		log.Printf("Unable to parse files: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	flashes, err := flash.GetFlashes(w, r)
+	if err != nil {
+		log.Printf("Failed to get flashes: %s\n", err)
+	}
+	values["Flashes"] = flashes
+	values["OIDC"] = oidcIssuer != ""
+	err = ts.ExecuteTemplate(w, "base", values)
+	if err != nil {
+		log.Printf("Failed to execute template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	if len(store.Users()) == 0 {
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	next := safeNext(r.FormValue("next"))
+	if r.Method == http.MethodPost {
+		// Otherwise another site could log the user in as someone else
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+		user, err := checkPassword(strings.TrimSpace(r.FormValue("username")), r.FormValue("password"))
+		if err != nil {
+			log.Printf("Failed login for %q from %s", r.FormValue("username"), r.RemoteAddr)
+			flash.SetFlashes(w, []flash.Flash{{
+				Level:   flash.ERROR,
+				Message: "Incorrect username or password",
+			}})
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+		data, err := getCookie(r)
+		if err != nil {
+			data = make(map[string]string)
+		}
+		if err := signIn(w, data, user); err != nil {
+			log.Printf("Failed to set cookie: %s", err)
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		data = make(map[string]string)
+	}
+	username, fromProxy := proxyUsername(r)
+	renderAuthPage(w, r, "login", map[string]interface{}{
+		"Next":          next,
+		"ProxyUsername": username,
+		"FromProxy":     fromProxy,
+		"CSRF":          csrfToken(w, data),
+	})
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	data, err := getCookie(r)
+	if err != nil {
+		data = make(map[string]string)
+	}
+	r.ParseForm()
+	if data[userKey] != "" && !checkCSRF(w, r) {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	delete(data, userKey)
+	if err := setCookie(data, w); err != nil {
+		log.Printf("Failed to set cookie: %s", err)
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// setupPage sets up the first admin, with a username and password
+func setupPage(w http.ResponseWriter, r *http.Request) {
+	if len(store.Users()) > 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/setup", http.StatusSeeOther)
+			return
+		}
+		username := strings.TrimSpace(r.FormValue("username"))
+		var user *User
+		err := ErrNoUsername
+		if username != "" {
+			user, err = setupAdmin(User{Name: username, Username: username}, r.FormValue("password"))
+		}
+		if err != nil {
+			flash.SetFlashes(w, []flash.Flash{{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Unable to set up: %s", err),
+			}})
+			http.Redirect(w, r, "/setup", http.StatusSeeOther)
+			return
+		}
+		data, err := getCookie(r)
+		if err != nil {
+			data = make(map[string]string)
+		}
+		if err := signIn(w, data, user); err != nil {
+			log.Printf("Failed to set cookie: %s", err)
+		}
+		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+		return
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		data = make(map[string]string)
+	}
+	renderAuthPage(w, r, "setup", map[string]interface{}{"CSRF": csrfToken(w, data)})
+}
+
+// accountPage changes the username and password the user logs in with
+func accountPage(w http.ResponseWriter, r *http.Request) {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	user, ok := userFromCookie(w, data)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/account", http.StatusSeeOther)
+			return
+		}
+		err := changeLogin(user, r.FormValue("username"), r.FormValue("current"), r.FormValue("password"))
+		if err != nil {
+			flash.SetFlashes(w, []flash.Flash{{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Unable to change how you log in: %s", err),
+			}})
+		} else {
+			flash.SetFlashes(w, []flash.Flash{{
+				Level:   flash.INFO,
+				Message: "Your username and password have been changed",
+			}})
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	renderAuthPage(w, r, "account", map[string]interface{}{"User": user, "CSRF": csrfToken(w, data)})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeNext(t *testing.T) {
+	tests := map[string]string{
+		"":                    "/",
+		"/history?device=abc": "/history?device=abc",
+		"https://example.com": "/",
+		"//example.com":       "/",
+		"/\\example.com":      "/",
+	}
+	for next, expected := range tests {
+		if safeNext(next) != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, next, safeNext(next))
+		}
+	}
+}
+
+func TestSetupAdminOnce(t *testing.T) {
+	newFakeSDM(t)
+	admin, err := setupAdmin(User{Name: "admin", Username: "admin"}, "password")
+	if err != nil {
+		t.Fatalf("Failed to set up admin: %s", err)
+	}
+	if !admin.IsAdmin() || admin.HouseholdID == "" {
+		t.Errorf("Expected an admin of a new household, got %+v", admin)
+	}
+	_, err = setupAdmin(User{Name: "other", Username: "other"}, "password")
+	if !errors.Is(err, ErrAlreadySetUp) {
+		t.Errorf("Expected ErrAlreadySetUp, got %v", err)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	newFakeSDM(t)
+	admin, _ := setupAdmin(User{Name: "admin", Username: "admin"}, "password")
+	if _, err := hashPassword("short"); !errors.Is(err, ErrPasswordLength) {
+		t.Errorf("Expected ErrPasswordLength, got %v", err)
+	}
+
+	user, err := checkPassword("Admin", "password")
+	if err != nil || user.ID != admin.ID {
+		t.Errorf("Expected to log in as the admin, got %v %v", user, err)
+	}
+	for _, login := range [][2]string{{"admin", "wrong-password"}, {"nobody", "password"}} {
+		if _, err := checkPassword(login[0], login[1]); !errors.Is(err, ErrInvalidLogin) {
+			t.Errorf("Expected ErrInvalidLogin for %s, got %v", login[0], err)
+		}
+	}
+
+	err = changeLogin(admin, "root", "wrong-password", "new-password")
+	if !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("Expected the current password to be needed, got %v", err)
+	}
+	err = changeLogin(admin, "root", "password", "new-password")
+	if err != nil {
+		t.Fatalf("Failed to change login: %s", err)
+	}
+	if _, err := checkPassword("root", "new-password"); err != nil {
+		t.Errorf("Expected to log in with the new username and password, got %v", err)
+	}
+
+	member, _ := newUser("Sam", RoleMember, admin.HouseholdID)
+	err = changeLogin(member, "root", "", "sams-password")
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected ErrUsernameTaken, got %v", err)
+	}
+}
+
+func TestIntegrationLoginRequired(t *testing.T) {
+	newFakeSDM(t)
+	for _, path := range []string{"/", "/authorize", "/cancel", "/history"} {
+		w := getPage(t, path, nil)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next="+url.QueryEscape(path) {
+			t.Errorf("Expected %s to redirect to /login, got %d %s", path, w.Code, w.Header().Get("Location"))
+		}
+	}
+	w := getPage(t, "/health", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected /health not to need a login, got %d", w.Code)
+	}
+	w = getPage(t, "/login", nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/setup" {
+		t.Errorf("Expected /login to redirect to /setup before anyone is set up, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIntegrationSetupAndLogin(t *testing.T) {
+	newFakeSDM(t)
+	// Another site can't set up the app, or log someone in, as the attacker
+	postForm(t, "/setup", url.Values{"username": {"attacker"}, "password": {"attackers-password"}}, nil)
+	if len(store.Users()) != 0 {
+		t.Fatalf("Expected setting up without the CSRF token to be rejected")
+	}
+	setupCookies := getPage(t, "/setup", nil).Result().Cookies()
+	w := postForm(t, "/setup", url.Values{"username": {"admin"}, "password": {"password"}}, setupCookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/authorize" {
+		t.Fatalf("Expected a redirect to /authorize, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	admin := cookieUser(t, w.Result().Cookies())
+	if !admin.IsAdmin() {
+		t.Errorf("Expected the user set up to be an admin")
+	}
+	w = getPage(t, "/authorize", w.Result().Cookies())
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Click here") {
+		t.Errorf("Expected the admin to be offered to authorize access, got %d", w.Code)
+	}
+
+	w = postForm(t, "/login", url.Values{"username": {"admin"}, "password": {"password"}, "next": {"/history"}}, nil)
+	if _, ok := cookieData(t, w.Result().Cookies())[userKey]; ok {
+		t.Errorf("Expected a login without the CSRF token to be rejected")
+	}
+	loginCookies := getPage(t, "/login", nil).Result().Cookies()
+	w = postForm(t, "/login", url.Values{"username": {"admin"}, "password": {"wrong-password"}, "next": {"/history"}}, loginCookies)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("Expected a failed login to redirect back to /login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w = postForm(t, "/login", url.Values{"username": {"admin"}, "password": {"password"}, "next": {"/history"}}, loginCookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/history" {
+		t.Fatalf("Expected a redirect to /history, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if cookieUser(t, cookies).ID != admin.ID {
+		t.Errorf("Expected to be logged in as the admin")
+	}
+
+	cookies = updateCookies(cookies, getPage(t, "/account", cookies))
+	w = postForm(t, "/logout", nil, cookies)
+	w = getPage(t, "/history", updateCookies(cookies, w))
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("Expected to be logged out, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIntegrationProxyAuth(t *testing.T) {
+	newFakeSDM(t)
+	oldHeader, oldProxies := proxyAuthHeader, trustedProxies
+	t.Cleanup(func() {
+		proxyAuthHeader, trustedProxies = oldHeader, oldProxies
+	})
+	proxyAuthHeader = "Remote-User"
+	trustedProxies = parseCIDRs("10.0.0.0/8, 192.0.2.1")
+
+	request := func(remoteAddr, username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/history", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Remote-User", username)
+		w := httptest.NewRecorder()
+		newServeMux().ServeHTTP(w, r)
+		return w
+	}
+	w := request("203.0.113.5:1234", "admin")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("Expected the header to be ignored from an untrusted address, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	// The first user through the proxy sets up the app
+	w = request("192.0.2.1:1234", "admin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the history page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	admin, ok := userByUsername("admin")
+	if !ok || !admin.IsAdmin() || cookieUser(t, w.Result().Cookies()).ID != admin.ID {
+		t.Errorf("Expected to be logged in as the admin, got %+v", admin)
+	}
+	w = request("10.1.2.3:1234", "stranger")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("Expected users who haven't been invited to be sent to /login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// newFakeOIDC starts an OpenID Connect provider which issues ID tokens with the
+// given subject and the nonce it was last sent
+func newFakeOIDC(t *testing.T, subject string) *httptest.Server {
+	t.Helper()
+	var nonce string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/authorize",
+			TokenEndpoint:         server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		nonce = r.URL.Query().Get("nonce")
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "client" || clientSecret != "secret" || r.FormValue("code") != "oidc-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   server.URL,
+			"sub":   subject,
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": nonce,
+			"name":  "Sam",
+		})
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".signature",
+		})
+	})
+
+	oldIssuer, oldClientID, oldClientSecret := oidcIssuer, oidcClientID, oidcClientSecret
+	t.Cleanup(func() {
+		oidcIssuer, oidcClientID, oidcClientSecret = oldIssuer, oldClientID, oldClientSecret
+		oidcDiscovered = nil
+	})
+	oidcIssuer, oidcClientID, oidcClientSecret = server.URL, "client", "secret"
+	oidcDiscovered = nil
+	return server
+}
+
+// oidcLoginFlow logs in with the fake provider, returning the response to the
+// callback
+func oidcLoginFlow(t *testing.T, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	w := getPage(t, path, cookies)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect to the provider, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	// Visit the provider, so it knows the nonce
+	resp, err := http.Get(location.String())
+	if err != nil {
+		t.Fatalf("Failed to visit the provider: %s", err)
+	}
+	resp.Body.Close()
+	callback := "/login/oidc/callback?code=oidc-code&state=" + location.Query().Get("state")
+	return getPage(t, callback, w.Result().Cookies())
+}
+
+func TestIntegrationOIDCJoin(t *testing.T) {
+	fake := newFakeSDM(t)
+	newFakeOIDC(t, "sam-subject")
+	admin := cookieUser(t, authorizedCookies(t, fake, "refresh-token"))
+	invite, err := inviteUser(admin, "Sam", RoleMember)
+	if err != nil {
+		t.Fatalf("Failed to invite: %s", err)
+	}
+
+	w := oidcLoginFlow(t, "/login/oidc", nil)
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "haven't been invited") {
+		t.Errorf("Expected someone without an invite not to be logged in, got %v", messages)
+	}
+
+	w = oidcLoginFlow(t, "/login/oidc?invite="+invite.ID, nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a redirect to /, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	member := cookieUser(t, w.Result().Cookies())
+	if member.Name != "Sam" || member.OIDCSubject != "sam-subject" || member.HouseholdID != admin.HouseholdID {
+		t.Errorf("Expected Sam to join the household, got %+v", member)
+	}
+
+	// Sam logs in again without the invite
+	w = oidcLoginFlow(t, "/login/oidc?next=/history", nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/history" {
+		t.Fatalf("Expected a redirect to /history, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if cookieUser(t, w.Result().Cookies()).ID != member.ID {
+		t.Errorf("Expected to log in as Sam again")
+	}
+}
+
+func TestIntegrationOIDCState(t *testing.T) {
+	newFakeSDM(t)
+	newFakeOIDC(t, "sam-subject")
+	w := getPage(t, "/login/oidc", nil)
+	w = getPage(t, "/login/oidc/callback?code=oidc-code&state=forged", w.Result().Cookies())
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "login has expired") {
+		t.Errorf("Expected a login with the wrong state to fail, got %v", messages)
+	}
+	if len(store.Users()) != 0 {
+		t.Errorf("Expected nobody to be set up")
+	}
+}
+
+func TestIDTokenValidate(t *testing.T) {
+	now := time.Now()
+	valid := idTokenClaims{Issuer: "issuer", Subject: "subject", Audience: audience{"client"}, Expiry: now.Add(time.Hour).Unix(), Nonce: "nonce"}
+	if err := valid.validate("issuer", "client", "nonce", now); err != nil {
+		t.Errorf("Expected the ID token to be valid, got %s", err)
+	}
+	tests := map[string]func(claims *idTokenClaims){
+		"issuer":   func(claims *idTokenClaims) { claims.Issuer = "other" },
+		"audience": func(claims *idTokenClaims) { claims.Audience = audience{"other"} },
+		"expired":  func(claims *idTokenClaims) { claims.Expiry = now.Add(-time.Minute).Unix() },
+		"nonce":    func(claims *idTokenClaims) { claims.Nonce = "other" },
+		"subject":  func(claims *idTokenClaims) { claims.Subject = "" },
+	}
+	for name, change := range tests {
+		claims := valid
+		change(&claims)
+		if claims.validate("issuer", "client", "nonce", now) == nil {
+			t.Errorf("Expected an ID token with the wrong %s to be invalid", name)
+		}
+	}
+
+	var aud audience
+	if json.Unmarshal([]byte(`["other", "client"]`), &aud) != nil || !aud.contains("client") {
+		t.Errorf("Expected a list of audiences to be parsed, got %v", aud)
+	}
+}
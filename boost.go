@@ -0,0 +1,749 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+var (
+	ErrNoActiveBoost   = errors.New("no active boost for device")
+	ErrBoostInProgress = errors.New("a boost is already running on this device")
+
+	activeBoostsMu sync.Mutex
+	// activeBoosts holds the boosts currently running, keyed by device ID
+	activeBoosts = make(map[string]*activeBoost)
+
+	// pollInterval is how often the room temperature is checked for boosts
+	// which run until it is reached. This is backed off up to maxPollInterval
+	// when rate limited.
+	pollInterval    = time.Minute * 5
+	maxPollInterval = time.Minute * 40
+
+	// revertRetryInterval is how long to wait before trying to revert a boost
+	// again after a temporary failure, such as the network not being ready
+	// after a restart. This is doubled up to maxRevertRetryInterval.
+	revertRetryInterval    = time.Minute
+	maxRevertRetryInterval = time.Hour
+
+	deviceLocksMu sync.Mutex
+	deviceLocks   = make(map[string]*sync.Mutex)
+)
+
+// BoostJob is the durable record of a running boost. It holds everything
+// needed to revert the thermostat, even after a restart of the server.
+type BoostJob struct {
+	ID          string  `json:"id"`
+	DeviceID    string  `json:"deviceId"`
+	Temperature float32 `json:"temperature"`
+	// Original and Boosted hold the full setpoints for the thermostat mode,
+	// which is needed for cooling and heat-cool ranges. Temperature is the
+	// primary temperature of Boosted.
+	Original nest.Setpoint `json:"original"`
+	Boosted  nest.Setpoint `json:"boosted"`
+	// RestoreMode is the mode to put the thermostat back into when the boost
+	// ends, if it had to be turned on for the boost. RestoreEco is set if eco
+	// mode had to be turned off.
+	RestoreMode string    `json:"restoreMode"`
+	RestoreEco  bool      `json:"restoreEco"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	// HouseholdID is the household which started the boost, and whose
+	// refresh token in the vault is used to revert it
+	HouseholdID string `json:"householdId"`
+	// UntilReached ends the boost early once the room is within Delta of the
+	// boosted temperature. End is then the latest the boost can run until.
+	UntilReached bool    `json:"untilReached"`
+	Delta        float32 `json:"delta"`
+}
+
+// BoostRequest holds the details of a boost asked for by a user
+type BoostRequest struct {
+	DeviceID    string  `json:"deviceId"`
+	Temperature float32 `json:"temperature"`
+	// Duration of the boost, in minutes
+	Duration    int    `json:"duration"`
+	Replace     bool   `json:"replace"`
+	RequestedBy string `json:"requestedBy"`
+	// UntilReached stops the boost once the room reaches the temperature,
+	// less Delta. Duration is then the maximum time to boost for.
+	UntilReached bool    `json:"untilReached"`
+	Delta        float32 `json:"delta"`
+	// SwitchMode allows a thermostat which is off or in eco mode to be turned
+	// on for the boost
+	SwitchMode bool `json:"switchMode"`
+}
+
+// boostState is the state of a device captured when starting a boost, so it
+// can be restored afterwards
+type boostState struct {
+	Original    nest.Setpoint
+	Boosted     nest.Setpoint
+	RestoreMode string
+	RestoreEco  bool
+}
+
+type activeBoost struct {
+	job        BoostJob
+	cancel     chan struct{}
+	replaced   chan struct{}
+	reschedule chan struct{}
+	// abandoned is closed when the boost can no longer be reverted, with the
+	// reason in abandonReason
+	abandoned     chan struct{}
+	abandonReason error
+	// cancelled is set when cancel is closed, and reverting once the boost
+	// has ended. Either way, the boost stays in activeBoosts until it has been
+	// reverted, but is no longer shown and can't be changed.
+	cancelled bool
+	reverting bool
+}
+
+// ended reports whether the boost is only waiting to be reverted. This must be
+// called holding activeBoostsMu.
+func (a *activeBoost) ended() bool {
+	return a.cancelled || a.reverting
+}
+
+// boostedSetpoint returns the setpoint to boost to. In HEATCOOL mode, the whole
+// range is moved so the heat setpoint is the target temperature.
+func boostedSetpoint(original nest.Setpoint, temperature float32) nest.Setpoint {
+	boosted := original
+	switch original.Mode {
+	case nest.ThermostatModeCool:
+		boosted.CoolCelsius = temperature
+	case nest.ThermostatModeHeatCool:
+		boosted.HeatCelsius = temperature
+		boosted.CoolCelsius += temperature - original.HeatCelsius
+	default:
+		boosted.HeatCelsius = temperature
+	}
+	return boosted
+}
+
+// setpointUnchanged reports whether the device is still in the mode the boost
+// set, with the setpoints for that mode within 0.3°C of the boosted ones. In
+// HEATCOOL mode both ends of the range must match.
+func setpointUnchanged(current, expected nest.Setpoint) bool {
+	if current.Mode != expected.Mode {
+		return false
+	}
+	switch current.Mode {
+	case nest.ThermostatModeCool:
+		return temperatureUnchanged(current.CoolCelsius, expected.CoolCelsius)
+	case nest.ThermostatModeHeatCool:
+		return temperatureUnchanged(current.HeatCelsius, expected.HeatCelsius) &&
+			temperatureUnchanged(current.CoolCelsius, expected.CoolCelsius)
+	default:
+		return temperatureUnchanged(current.HeatCelsius, expected.HeatCelsius)
+	}
+}
+
+// temperatureUnchanged reports whether the current setpoint is still (roughly)
+// the one set by the boost.
+func temperatureUnchanged(current, expected float32) bool {
+	return !(current+0.3 < expected || current-0.3 > expected)
+}
+
+// startBoost sets the device to the desired temperature and records the boost,
+// reverting it in the background once the duration has passed. If a boost is
+// already running on the device, it is either replaced (keeping the original
+// temperature it captured) or ErrBoostInProgress is returned. A cancelled or
+// ended boost which hasn't been reverted yet is always replaced. A boost started by another
+// household is never replaced, and ErrBoostInProgress is returned without it.
+func startBoost(householdID string, token Token, request BoostRequest) (*BoostJob, error) {
+	deviceID := request.DeviceID
+	unlock := lockDevice(deviceID)
+	defer unlock()
+
+	// The running boost's job can be changed by changeBoostEnd and cancelBoost,
+	// which don't take the device lock, so copy it while holding activeBoostsMu
+	activeBoostsMu.Lock()
+	previous, busy := activeBoosts[deviceID]
+	var previousJob *BoostJob
+	ended := false
+	if busy {
+		job := previous.job
+		previousJob = &job
+		ended = previous.ended()
+	}
+	activeBoostsMu.Unlock()
+	if busy && previousJob.HouseholdID != householdID {
+		return nil, ErrBoostInProgress
+	}
+	if busy && !request.Replace && !ended {
+		return previousJob, ErrBoostInProgress
+	}
+
+	now := time.Now()
+	entry := HistoryEntry{
+		ID:                   newID(),
+		HouseholdID:          householdID,
+		DeviceID:             deviceID,
+		RequestedBy:          request.RequestedBy,
+		RequestedTemperature: request.Temperature,
+		Duration:             request.Duration,
+		UntilReached:         request.UntilReached,
+		Start:                now,
+		Outcome:              OutcomeRunning,
+	}
+	state, err := setBoostTemperature(token, request, previousJob)
+	entry.Mode = state.Original.Mode
+	entry.OriginalTemperature = state.Original.Primary()
+	if err != nil {
+		entry.Outcome = OutcomeFailed
+		entry.End = now
+		entry.Error = err.Error()
+	}
+	if historyErr := store.AddHistory(entry); historyErr != nil {
+		log.Printf("Failed to add history for boost %s: %s", entry.ID, historyErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job := BoostJob{
+		ID:           entry.ID,
+		DeviceID:     deviceID,
+		Temperature:  request.Temperature,
+		Original:     state.Original,
+		Boosted:      state.Boosted,
+		RestoreMode:  state.RestoreMode,
+		RestoreEco:   state.RestoreEco,
+		Start:        now,
+		End:          now.Add(time.Minute * time.Duration(request.Duration)),
+		HouseholdID:  householdID,
+		UntilReached: request.UntilReached,
+		Delta:        request.Delta,
+	}
+	err = store.PutBoost(&job)
+	if err != nil {
+		log.Printf("Failed to save boost %s: %s", job.ID, err)
+	}
+
+	active := newActiveBoost(job)
+	activeBoostsMu.Lock()
+	if current, ok := activeBoosts[deviceID]; ok && current == previous {
+		close(previous.replaced)
+	}
+	activeBoosts[deviceID] = active
+	activeBoostsMu.Unlock()
+	go waitAndRevert(active)
+	return &job, nil
+}
+
+// setBoostTemperature captures the original state of the device and sets the
+// boosted temperature. previous is the boost being replaced, if any.
+func setBoostTemperature(token Token, request BoostRequest, previous *BoostJob) (boostState, error) {
+	state := boostState{}
+	if previous != nil {
+		// The current setpoint is the boosted one, so carry over the original
+		state.Original = previous.Original
+		state.RestoreMode = previous.RestoreMode
+		state.RestoreEco = previous.RestoreEco
+	} else {
+		err := captureDeviceState(token, request, &state)
+		if err != nil {
+			return state, err
+		}
+	}
+
+	state.Boosted = boostedSetpoint(state.Original, request.Temperature)
+	err := nest.SetSetpoint(nestClient, token.AccessToken, request.DeviceID, state.Boosted)
+	if err != nil {
+		if previous == nil {
+			undoModeSwitch(token, request.DeviceID, state)
+		}
+		return state, fmt.Errorf("failed to set temperature: %w", err)
+	}
+	return state, nil
+}
+
+// captureDeviceState reads the original setpoint of the device. If the device
+// is off or in eco mode and the request allows it, the device is switched to
+// heating first.
+func captureDeviceState(token Token, request BoostRequest, state *boostState) error {
+	device, err := nestClient.GetDevice(token.AccessToken, request.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get initial temperature: %w", err)
+	}
+	traits := device.Traits
+	if request.SwitchMode && (traits.EcoEnabled() || traits.ThermostatMode.Mode == nest.ThermostatModeOff) {
+		if traits.EcoEnabled() {
+			err = nest.SetEcoMode(nestClient, token.AccessToken, request.DeviceID, nest.EcoModeOff)
+			if err != nil {
+				return fmt.Errorf("failed to turn off eco mode: %w", err)
+			}
+			state.RestoreEco = true
+		}
+		if traits.ThermostatMode.Mode == nest.ThermostatModeOff {
+			err = nest.SetMode(nestClient, token.AccessToken, request.DeviceID, nest.ThermostatModeHeat)
+			if err != nil {
+				undoModeSwitch(token, request.DeviceID, *state)
+				return fmt.Errorf("failed to turn on heating: %w", err)
+			}
+			state.RestoreMode = nest.ThermostatModeOff
+		}
+		// The setpoints are only reported for the mode the device is now in
+		device, err = nestClient.GetDevice(token.AccessToken, request.DeviceID)
+		if err != nil {
+			undoModeSwitch(token, request.DeviceID, *state)
+			return fmt.Errorf("failed to get initial temperature: %w", err)
+		}
+		traits = device.Traits
+	}
+	setpoint, err := nest.SetpointFromTraits(traits)
+	if err != nil {
+		undoModeSwitch(token, request.DeviceID, *state)
+		return fmt.Errorf("failed to get initial temperature: %w", err)
+	}
+	state.Original = *setpoint
+	return nil
+}
+
+// restoreDeviceMode puts the device back into eco mode and/or the mode it was
+// in before the boost
+func restoreDeviceMode(token Token, deviceID string, restoreMode string, restoreEco bool) error {
+	if restoreEco {
+		err := nest.SetEcoMode(nestClient, token.AccessToken, deviceID, nest.EcoModeManual)
+		if err != nil {
+			return fmt.Errorf("failed to turn eco mode back on: %w", err)
+		}
+	}
+	if restoreMode != "" {
+		err := nest.SetMode(nestClient, token.AccessToken, deviceID, restoreMode)
+		if err != nil {
+			return fmt.Errorf("failed to set mode back to %s: %w", restoreMode, err)
+		}
+	}
+	return nil
+}
+
+// undoModeSwitch restores the mode of a device when a boost failed to start
+func undoModeSwitch(token Token, deviceID string, state boostState) {
+	err := restoreDeviceMode(token, deviceID, state.RestoreMode, state.RestoreEco)
+	if err != nil {
+		log.Printf("Failed to restore mode of %s: %s", deviceID, err)
+	}
+}
+
+// lockDevice serialises changes to a single device, so that two boosts can't
+// both capture the original temperature. The returned function releases it.
+func lockDevice(deviceID string) func() {
+	deviceLocksMu.Lock()
+	lock, ok := deviceLocks[deviceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		deviceLocks[deviceID] = lock
+	}
+	deviceLocksMu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func newActiveBoost(job BoostJob) *activeBoost {
+	return &activeBoost{
+		job:        job,
+		cancel:     make(chan struct{}),
+		replaced:   make(chan struct{}),
+		reschedule: make(chan struct{}, 1),
+		abandoned:  make(chan struct{}),
+	}
+}
+
+func waitAndRevert(active *activeBoost) {
+	activeBoostsMu.Lock()
+	job := active.job
+	activeBoostsMu.Unlock()
+
+	cancelled := false
+	source := accessTokens.Source(job.HouseholdID)
+	timer := time.NewTimer(time.Until(job.End))
+	// Only poll the room temperature for boosts which run until it is reached
+	var poll <-chan time.Time
+	var pollTimer *time.Timer
+	interval := pollInterval
+	if job.UntilReached {
+		pollTimer = time.NewTimer(interval)
+		defer pollTimer.Stop()
+		poll = pollTimer.C
+	}
+wait:
+	for {
+		select {
+		case <-timer.C:
+			break wait
+		case <-poll:
+			reached, err := targetReached(source, job)
+			interval = nextPollInterval(interval, err)
+			switch {
+			case errors.Is(err, nest.ErrRateLimit):
+				log.Printf("Rate limited checking temperature for boost %s. Checking again in %s", job.ID, interval)
+			case err != nil:
+				log.Printf("Failed to check temperature for boost %s: %s", job.ID, err)
+			case reached:
+				timer.Stop()
+				log.Printf("Boost %s on %s reached its target temperature", job.ID, job.DeviceID)
+				recordHistory(job.ID, func(entry *HistoryEntry) {
+					entry.TargetReached = true
+				})
+				break wait
+			}
+			pollTimer.Reset(interval)
+		case <-active.cancel:
+			timer.Stop()
+			log.Printf("Boost %s on %s cancelled", job.ID, job.DeviceID)
+			cancelled = true
+			break wait
+		case <-active.replaced:
+			timer.Stop()
+			finishWithoutReverting(active, job)
+			return
+		case <-active.abandoned:
+			timer.Stop()
+			finishWithoutReverting(active, job)
+			return
+		case <-active.reschedule:
+			activeBoostsMu.Lock()
+			job = active.job
+			activeBoostsMu.Unlock()
+			if !timer.Stop() {
+				// Drain a tick which fired before the end time changed
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(job.End))
+			log.Printf("Boost %s on %s now ends at %s", job.ID, job.DeviceID, job.End)
+		}
+	}
+
+	// Keep the boost in activeBoosts until it has been reverted, so a new boost
+	// carries over the original temperature rather than capturing the boosted
+	// one, even while waiting to try reverting again
+	activeBoostsMu.Lock()
+	active.reverting = true
+	activeBoostsMu.Unlock()
+	retry := revertRetryInterval
+	for !revertActiveBoost(active, cancelled) {
+		log.Printf("Trying to revert boost %s again in %s", job.ID, retry)
+		retryTimer := time.NewTimer(retry)
+		select {
+		case <-retryTimer.C:
+		case <-active.replaced:
+		case <-active.abandoned:
+		}
+		retryTimer.Stop()
+		retry = min(retry*2, maxRevertRetryInterval)
+	}
+}
+
+// revertActiveBoost reverts a boost which has ended while holding the device
+// lock, then removes it from activeBoosts. A boost which has been replaced or
+// abandoned is left as it is. It returns false if reverting failed for a
+// temporary reason, and should be tried again.
+func revertActiveBoost(active *activeBoost, cancelled bool) bool {
+	activeBoostsMu.Lock()
+	deviceID := active.job.DeviceID
+	activeBoostsMu.Unlock()
+	unlock := lockDevice(deviceID)
+	defer unlock()
+	activeBoostsMu.Lock()
+	job := active.job
+	current := activeBoosts[deviceID] == active
+	activeBoostsMu.Unlock()
+	if !current {
+		finishWithoutReverting(active, job)
+		return true
+	}
+	if !revertBoost(job, cancelled) {
+		return false
+	}
+	activeBoostsMu.Lock()
+	if activeBoosts[deviceID] == active {
+		delete(activeBoosts, deviceID)
+	}
+	activeBoostsMu.Unlock()
+	return true
+}
+
+// finishWithoutReverting records a boost which was replaced by a new boost or
+// abandoned, leaving the temperature as it is
+func finishWithoutReverting(active *activeBoost, job BoostJob) {
+	select {
+	case <-active.replaced:
+		log.Printf("Boost %s on %s replaced by a new boost", job.ID, job.DeviceID)
+		recordHistory(job.ID, func(entry *HistoryEntry) {
+			entry.Outcome = OutcomeReplaced
+			entry.End = time.Now()
+		})
+	default:
+		log.Printf("Boost %s on %s abandoned: %s", job.ID, job.DeviceID, active.abandonReason)
+		recordHistory(job.ID, func(entry *HistoryEntry) {
+			entry.Outcome = OutcomeFailed
+			entry.End = time.Now()
+			entry.Error = fmt.Sprintf("%s, so the temperature was left at %s", active.abandonReason, job.Boosted)
+		})
+	}
+	err := store.DeleteBoost(job.ID)
+	if err != nil {
+		log.Printf("Failed to remove boost %s: %s", job.ID, err)
+	}
+}
+
+// nextPollInterval returns how long to wait before checking the room
+// temperature again. This is doubled when rate limited, to avoid using up the
+// quota for the project, and goes back to pollInterval once a check succeeds.
+func nextPollInterval(interval time.Duration, err error) time.Duration {
+	switch {
+	case errors.Is(err, nest.ErrRateLimit):
+		return min(interval*2, maxPollInterval)
+	case err != nil:
+		return interval
+	default:
+		return pollInterval
+	}
+}
+
+// targetReached reports whether the room has warmed up (or cooled down, when
+// cooling) to within the delta of the boosted temperature
+func targetReached(source TokenSource, job BoostJob) (bool, error) {
+	token, err := source.Token()
+	if err != nil {
+		return false, err
+	}
+	ambient, err := nest.GetAmbientTemperature(nestClient, token.AccessToken, job.DeviceID)
+	if err != nil {
+		return false, err
+	}
+	if job.Boosted.Mode == nest.ThermostatModeCool {
+		return *ambient <= job.Temperature+job.Delta, nil
+	}
+	return *ambient >= job.Temperature-job.Delta, nil
+}
+
+// cancelBoost stops the household's active boost on a device early. The
+// original temperature is restored in the background, which removes the boost
+// from activeBoosts while holding the device lock.
+func cancelBoost(householdID, deviceID string) (*BoostJob, error) {
+	activeBoostsMu.Lock()
+	defer activeBoostsMu.Unlock()
+	active, ok := activeBoosts[deviceID]
+	if !ok || active.job.HouseholdID != householdID || active.ended() {
+		return nil, ErrNoActiveBoost
+	}
+	active.cancelled = true
+	close(active.cancel)
+	job := active.job
+	return &job, nil
+}
+
+// abandonBoosts stops the running boosts started by a household without
+// reverting them, as its refresh token can no longer be used to change the
+// thermostat
+func abandonBoosts(householdID string, reason error) {
+	activeBoostsMu.Lock()
+	defer activeBoostsMu.Unlock()
+	for deviceID, active := range activeBoosts {
+		if active.job.HouseholdID != householdID {
+			continue
+		}
+		delete(activeBoosts, deviceID)
+		active.abandonReason = reason
+		close(active.abandoned)
+	}
+}
+
+// changeBoostEnd moves the end time of the household's active boost on a
+// device by the given amount, which may be negative to shorten the boost. The
+// original temperature captured when the boost started is kept.
+func changeBoostEnd(householdID, deviceID string, change time.Duration) (*BoostJob, error) {
+	activeBoostsMu.Lock()
+	defer activeBoostsMu.Unlock()
+	active, ok := activeBoosts[deviceID]
+	if !ok || active.job.HouseholdID != householdID || active.ended() {
+		return nil, ErrNoActiveBoost
+	}
+	end := active.job.End.Add(change)
+	if end.Before(time.Now()) {
+		end = time.Now()
+	}
+	active.job.End = end
+	err := store.PutBoost(&active.job)
+	if err != nil {
+		log.Printf("Failed to save boost %s: %s", active.job.ID, err)
+	}
+	select {
+	case active.reschedule <- struct{}{}:
+	default:
+		// A reschedule is already pending and will pick up the new end time
+	}
+	job := active.job
+	return &job, nil
+}
+
+// getActiveBoosts returns the boosts currently running for the household
+func getActiveBoosts(householdID string) []BoostJob {
+	activeBoostsMu.Lock()
+	defer activeBoostsMu.Unlock()
+	jobs := make([]BoostJob, 0, len(activeBoosts))
+	for _, active := range activeBoosts {
+		if active.job.HouseholdID == householdID && !active.ended() {
+			jobs = append(jobs, active.job)
+		}
+	}
+	return jobs
+}
+
+// BoostView is a boost as shown on the home page
+type BoostView struct {
+	BoostJob
+	DisplayName string
+}
+
+// Remaining returns the time left on the boost, rounded to the second
+func (b *BoostView) Remaining() time.Duration {
+	remaining := time.Until(b.End).Round(time.Second)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// displayNames maps device IDs to the names shown to users
+type displayNames map[string]string
+
+func deviceNames(devices []nest.Device) displayNames {
+	names := make(displayNames, len(devices))
+	for _, device := range devices {
+		names[device.DeviceID()] = device.DisplayName()
+	}
+	return names
+}
+
+// get returns the display name for the device, falling back to the device ID
+// if the device is unknown
+func (n displayNames) get(deviceID string) string {
+	if name, ok := n[deviceID]; ok {
+		return name
+	}
+	return deviceID
+}
+
+// getBoostViews returns the household's active boosts, ending soonest first,
+// with the display name of the thermostat they are running on.
+func getBoostViews(householdID string, devices []nest.Device) []BoostView {
+	names := deviceNames(devices)
+	jobs := getActiveBoosts(householdID)
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].End.Before(jobs[j].End)
+	})
+	views := make([]BoostView, 0, len(jobs))
+	for _, job := range jobs {
+		views = append(views, BoostView{BoostJob: job, DisplayName: names.get(job.DeviceID)})
+	}
+	return views
+}
+
+// revertBoost restores the original temperature for a boost which has finished
+// and removes it from the store. The outcome is recorded in the history. If
+// reverting failed for a temporary reason, the boost is kept in the store and
+// false is returned. The caller must hold the device lock.
+func revertBoost(job BoostJob, cancelled bool) bool {
+	outcome, err := restoreTemperature(accessTokens.Source(job.HouseholdID), job)
+	if err != nil && temporaryError(err) {
+		log.Printf("Failed to revert boost %s: %s", job.ID, err)
+		if errors.Is(err, nest.ErrUnauthenticated) {
+			accessTokens.Forget(job.HouseholdID)
+		}
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to revert boost %s: %s", job.ID, err)
+	}
+	recordHistory(job.ID, func(entry *HistoryEntry) {
+		entry.Outcome = outcome
+		entry.End = time.Now()
+		entry.Cancelled = cancelled
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	})
+	err = store.DeleteBoost(job.ID)
+	if err != nil {
+		log.Printf("Failed to remove boost %s: %s", job.ID, err)
+	}
+	return true
+}
+
+// temporaryError reports whether an error changing a thermostat may go away by
+// itself, e.g. because the network or Nest was unavailable, rather than access
+// to the thermostat having been lost
+func temporaryError(err error) bool {
+	for _, permanent := range []error{
+		ErrInvalidGrant,
+		ErrNoRefreshToken,
+		nest.ErrPermissionDenied,
+		nest.ErrNotFound,
+		nest.ErrFailedPrecondition,
+		nest.ErrInvalidArgument,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+func restoreTemperature(source TokenSource, job BoostJob) (BoostOutcome, error) {
+	token, err := source.Token()
+	if err != nil {
+		return OutcomeFailed, fmt.Errorf("failed to get a new access token: %w", err)
+	}
+	current, err := nest.GetSetpoint(nestClient, token.AccessToken, job.DeviceID)
+	if errors.Is(err, nest.ErrThermostatOff) || errors.Is(err, nest.ErrEcoEnabled) {
+		log.Printf("Thermostat has been turned off or put into eco mode since boosting. Leaving as is")
+		return OutcomeSkipped, nil
+	}
+	if err != nil {
+		return OutcomeFailed, fmt.Errorf("failed to get temperature before resetting to normal: %w", err)
+	}
+	if !setpointUnchanged(*current, job.Boosted) {
+		log.Printf("Temperature has changed since boosting. Leaving as is: Current: %v, expected: %v", *current, job.Boosted)
+		return OutcomeSkipped, nil
+	}
+	err = nest.SetSetpoint(nestClient, token.AccessToken, job.DeviceID, job.Original)
+	if err != nil {
+		return OutcomeFailed, fmt.Errorf("failed to reset temperature: %w", err)
+	}
+	err = restoreDeviceMode(*token, job.DeviceID, job.RestoreMode, job.RestoreEco)
+	if err != nil {
+		return OutcomeFailed, err
+	}
+	return OutcomeReverted, nil
+}
+
+// resumeBoosts picks up boosts left over from a previous run of the server.
+// Boosts which should already have finished are reverted straight away, but
+// are still added to activeBoosts until then so that a new boost on the device
+// doesn't capture the boosted temperature as the original.
+func resumeBoosts() {
+	for _, job := range store.Boosts() {
+		if time.Now().After(job.End) {
+			log.Printf("Boost %s on %s ended while the server was down. Reverting", job.ID, job.DeviceID)
+		} else {
+			log.Printf("Resuming boost %s on %s until %s", job.ID, job.DeviceID, job.End)
+		}
+		active := newActiveBoost(job)
+		activeBoostsMu.Lock()
+		activeBoosts[job.DeviceID] = active
+		activeBoostsMu.Unlock()
+		go waitAndRevert(active)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+func TestTemperatureUnchanged(t *testing.T) {
+	if !temperatureUnchanged(21.1, 21) {
+		t.Errorf("Expected 21.1 to match 21")
+	}
+	if temperatureUnchanged(19, 21) {
+		t.Errorf("Expected 19 not to match 21")
+	}
+}
+
+func TestCancelBoostNoActiveBoost(t *testing.T) {
+	_, err := cancelBoost("household", "missing")
+	if err != ErrNoActiveBoost {
+		t.Errorf("Expected ErrNoActiveBoost, got %v", err)
+	}
+}
+
+func TestCancelBoost(t *testing.T) {
+	active := &activeBoost{job: BoostJob{ID: "abc", DeviceID: "device", HouseholdID: "household"}, cancel: make(chan struct{}), replaced: make(chan struct{})}
+	activeBoosts["device"] = active
+	defer delete(activeBoosts, "device")
+	if _, err := cancelBoost("other-household", "device"); err != ErrNoActiveBoost {
+		t.Errorf("Expected another household's boost not to be found, got %v", err)
+	}
+	job, err := cancelBoost("household", "device")
+	if err != nil {
+		t.Fatalf("Failed to cancel boost: %s", err)
+	}
+	if job.ID != "abc" {
+		t.Errorf("Expected boost abc, got %s", job.ID)
+	}
+	select {
+	case <-active.cancel:
+	default:
+		t.Errorf("Expected cancel channel to be closed")
+	}
+	if len(getActiveBoosts("household")) != 0 {
+		t.Errorf("Expected no active boosts")
+	}
+	if _, err := cancelBoost("household", "device"); err != ErrNoActiveBoost {
+		t.Errorf("Expected a cancelled boost not to be cancelled again, got %v", err)
+	}
+}
+
+func TestStartBoostReplacesCancelled(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	useMockNestClient(t, heatDevice("device", nest.ThermostatModeHeat, nest.EcoModeOff, 21))
+	previous := newActiveBoost(BoostJob{
+		ID:          "abc",
+		DeviceID:    "device",
+		HouseholdID: "household",
+		Original:    nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 18},
+		Boosted:     nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 21},
+	})
+	activeBoosts["device"] = previous
+	if _, err := cancelBoost("household", "device"); err != nil {
+		t.Fatalf("Failed to cancel boost: %s", err)
+	}
+
+	// The cancelled boost hasn't been reverted yet, so the device is still at
+	// the boosted temperature
+	job, err := startBoost("household", Token{AccessToken: "token"}, BoostRequest{DeviceID: "device", Temperature: 22, Duration: 30})
+	if err != nil {
+		t.Fatalf("Failed to start boost: %s", err)
+	}
+	// Stop the new boost without reverting it, as there's no access token
+	defer waitForBoostsToEnd(t)
+	defer abandonBoosts("household", errors.New("test finished"))
+	if job.Original.HeatCelsius != 18 {
+		t.Errorf("Expected the original temperature to be carried over, got %f", job.Original.HeatCelsius)
+	}
+	select {
+	case <-previous.replaced:
+	default:
+		t.Errorf("Expected the cancelled boost to be replaced")
+	}
+}
+
+func TestChangeBoostEnd(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	end := time.Now().Add(time.Hour)
+	active := &activeBoost{
+		job:        BoostJob{ID: "abc", DeviceID: "device", HouseholdID: "household", Original: nest.Setpoint{HeatCelsius: 18}, End: end},
+		cancel:     make(chan struct{}),
+		reschedule: make(chan struct{}, 1),
+	}
+	activeBoosts["device"] = active
+	defer delete(activeBoosts, "device")
+
+	if _, err := changeBoostEnd("other-household", "device", time.Minute*30); err != ErrNoActiveBoost {
+		t.Errorf("Expected another household's boost not to be found, got %v", err)
+	}
+	job, err := changeBoostEnd("household", "device", time.Minute*30)
+	if err != nil {
+		t.Fatalf("Failed to change boost end: %s", err)
+	}
+	if !job.End.Equal(end.Add(time.Minute * 30)) {
+		t.Errorf("Expected end %s, got %s", end.Add(time.Minute*30), job.End)
+	}
+	if job.Original.HeatCelsius != 18 {
+		t.Errorf("Expected original temperature to be kept, got %f", job.Original.HeatCelsius)
+	}
+	select {
+	case <-active.reschedule:
+	default:
+		t.Errorf("Expected a reschedule to be signalled")
+	}
+
+	job, _ = changeBoostEnd("household", "device", -time.Hour*2)
+	if job.End.After(time.Now()) {
+		t.Errorf("Expected boost to end now, got %s", job.End)
+	}
+}
+
+func TestChangeBoostEndNoActiveBoost(t *testing.T) {
+	_, err := changeBoostEnd("household", "missing", time.Minute)
+	if err != ErrNoActiveBoost {
+		t.Errorf("Expected ErrNoActiveBoost, got %v", err)
+	}
+}
+
+func TestStartBoostInProgress(t *testing.T) {
+	activeBoosts["device"] = newActiveBoost(BoostJob{ID: "abc", DeviceID: "device", HouseholdID: "household", Temperature: 21})
+	defer delete(activeBoosts, "device")
+
+	job, err := startBoost("household", Token{}, BoostRequest{DeviceID: "device", Temperature: 22, Duration: 30})
+	if err != ErrBoostInProgress {
+		t.Fatalf("Expected ErrBoostInProgress, got %v", err)
+	}
+	if job.ID != "abc" {
+		t.Errorf("Expected the running boost to be returned, got %s", job.ID)
+	}
+}
+
+func TestStartBoostOtherHousehold(t *testing.T) {
+	previous := newActiveBoost(BoostJob{ID: "abc", DeviceID: "device", HouseholdID: "household", Temperature: 21})
+	activeBoosts["device"] = previous
+	defer delete(activeBoosts, "device")
+
+	for _, replace := range []bool{false, true} {
+		job, err := startBoost("other-household", Token{}, BoostRequest{DeviceID: "device", Temperature: 22, Duration: 30, Replace: replace})
+		if err != ErrBoostInProgress {
+			t.Fatalf("Expected ErrBoostInProgress with replace %t, got %v", replace, err)
+		}
+		if job != nil {
+			t.Errorf("Expected another household's boost not to be returned, got %s", job.ID)
+		}
+	}
+	if activeBoosts["device"] != previous {
+		t.Errorf("Expected another household's boost not to be replaced")
+	}
+}
+
+// mockNestClient is a nest.Client which returns fixed devices and records the
+// commands it is asked to run. GetDevice returns getErrors in turn before the
+// device.
+type mockNestClient struct {
+	mu        sync.Mutex
+	devices   map[string]*nest.Device
+	commands  []nest.ExecuteCommandRequest
+	getErrors []error
+}
+
+func (m *mockNestClient) ListDevices(accessToken string) (*nest.Devices, error) {
+	devices := &nest.Devices{}
+	for _, device := range m.devices {
+		devices.Devices = append(devices.Devices, *device)
+	}
+	return devices, nil
+}
+
+func (m *mockNestClient) GetDevice(accessToken, deviceID string) (*nest.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.getErrors) > 0 {
+		err := m.getErrors[0]
+		m.getErrors = m.getErrors[1:]
+		return nil, err
+	}
+	device, ok := m.devices[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("no device %s", deviceID)
+	}
+	return device, nil
+}
+
+func (m *mockNestClient) ExecuteCommand(accessToken, deviceID string, command nest.ExecuteCommandRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, command)
+	return nil
+}
+
+func useMockNestClient(t *testing.T, devices ...*nest.Device) *mockNestClient {
+	mock := &mockNestClient{devices: make(map[string]*nest.Device)}
+	for _, device := range devices {
+		mock.devices[device.DeviceID()] = device
+	}
+	oldNestClient := nestClient
+	t.Cleanup(func() { nestClient = oldNestClient })
+	nestClient = mock
+	return mock
+}
+
+func heatDevice(id string, mode string, eco string, heatCelsius float32) *nest.Device {
+	device := &nest.Device{Name: "enterprises/project/devices/" + id}
+	device.Traits.ThermostatMode.Mode = mode
+	device.Traits.ThermostatEco.Mode = eco
+	device.Traits.ThermostatTemperatureSetpoint.HeatCelsius = &heatCelsius
+	return device
+}
+
+func TestSetBoostTemperature(t *testing.T) {
+	mock := useMockNestClient(t, heatDevice("device", nest.ThermostatModeHeat, nest.EcoModeOff, 18))
+
+	state, err := setBoostTemperature(Token{AccessToken: "token"}, BoostRequest{DeviceID: "device", Temperature: 21}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if state.Original.HeatCelsius != 18 || state.Boosted.HeatCelsius != 21 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if len(mock.commands) != 1 || mock.commands[0].Command != "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat" {
+		t.Fatalf("Expected a single SetHeat command, got %+v", mock.commands)
+	}
+	if mock.commands[0].Params["heatCelsius"] != float32(21) {
+		t.Errorf("Expected the heat setpoint to be 21, got %v", mock.commands[0].Params["heatCelsius"])
+	}
+}
+
+func TestSetBoostTemperatureEco(t *testing.T) {
+	mock := useMockNestClient(t, heatDevice("device", nest.ThermostatModeHeat, nest.EcoModeManual, 18))
+
+	_, err := setBoostTemperature(Token{AccessToken: "token"}, BoostRequest{DeviceID: "device", Temperature: 21}, nil)
+	if !errors.Is(err, nest.ErrEcoEnabled) {
+		t.Errorf("Expected ErrEcoEnabled, got %v", err)
+	}
+	if len(mock.commands) != 0 {
+		t.Errorf("Expected no commands, got %+v", mock.commands)
+	}
+}
+
+func TestGetBoostViews(t *testing.T) {
+	activeBoosts["device-1"] = newActiveBoost(BoostJob{ID: "a", DeviceID: "device-1", HouseholdID: "household", End: time.Now().Add(time.Hour)})
+	activeBoosts["device-2"] = newActiveBoost(BoostJob{ID: "b", DeviceID: "device-2", HouseholdID: "household", End: time.Now().Add(time.Minute)})
+	activeBoosts["device-3"] = newActiveBoost(BoostJob{ID: "c", DeviceID: "device-3", HouseholdID: "other-household", End: time.Now().Add(time.Minute)})
+	defer delete(activeBoosts, "device-1")
+	defer delete(activeBoosts, "device-2")
+	defer delete(activeBoosts, "device-3")
+	devices := []nest.Device{
+		{
+			Name:            "enterprises/project/devices/device-1",
+			ParentRelations: []nest.ParentRelation{{DisplayName: "Hallway"}},
+		},
+	}
+
+	views := getBoostViews("household", devices)
+	if len(views) != 2 {
+		t.Fatalf("Expected 2 boosts, got %d", len(views))
+	}
+	if views[0].ID != "b" || views[1].ID != "a" {
+		t.Errorf("Expected boosts to be ordered by end time")
+	}
+	if views[1].DisplayName != "Hallway" {
+		t.Errorf("Expected Hallway, got %s", views[1].DisplayName)
+	}
+	if views[0].DisplayName != "device-2" {
+		t.Errorf("Expected the device ID as a fallback, got %s", views[0].DisplayName)
+	}
+}
+
+func TestBoostedSetpoint(t *testing.T) {
+	tests := []struct {
+		original nest.Setpoint
+		expected nest.Setpoint
+	}{
+		{nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 18}, nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 21}},
+		{nest.Setpoint{Mode: nest.ThermostatModeCool, CoolCelsius: 25}, nest.Setpoint{Mode: nest.ThermostatModeCool, CoolCelsius: 21}},
+		{nest.Setpoint{Mode: nest.ThermostatModeHeatCool, HeatCelsius: 18, CoolCelsius: 24}, nest.Setpoint{Mode: nest.ThermostatModeHeatCool, HeatCelsius: 21, CoolCelsius: 27}},
+	}
+	for _, test := range tests {
+		boosted := boostedSetpoint(test.original, 21)
+		if boosted != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, boosted)
+		}
+	}
+}
+
+func TestSetpointUnchanged(t *testing.T) {
+	heat := nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 21}
+	if !setpointUnchanged(nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 21.1}, heat) {
+		t.Errorf("Expected heat setpoints to match")
+	}
+	if setpointUnchanged(nest.Setpoint{Mode: nest.ThermostatModeCool, CoolCelsius: 21}, heat) {
+		t.Errorf("Expected a change of mode not to match")
+	}
+	heatCool := nest.Setpoint{Mode: nest.ThermostatModeHeatCool, HeatCelsius: 20, CoolCelsius: 24}
+	if setpointUnchanged(nest.Setpoint{Mode: nest.ThermostatModeHeatCool, HeatCelsius: 20, CoolCelsius: 26}, heatCool) {
+		t.Errorf("Expected a change to the cool setpoint not to match")
+	}
+}
+
+// staticTokenSource hands out the same access token every time
+type staticTokenSource struct{}
+
+func (staticTokenSource) Token() (*Token, error) {
+	return &Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func ambientDevice(id string, mode string, ambient float32) *nest.Device {
+	device := heatDevice(id, mode, nest.EcoModeOff, 21)
+	device.Traits.Temperature.Temperature = ambient
+	return device
+}
+
+func TestTargetReached(t *testing.T) {
+	tests := []struct {
+		mode    string
+		ambient float32
+		reached bool
+	}{
+		{nest.ThermostatModeHeat, 20.4, false},
+		{nest.ThermostatModeHeat, 20.5, true},
+		{nest.ThermostatModeHeat, 22, true},
+		{nest.ThermostatModeCool, 21.6, false},
+		{nest.ThermostatModeCool, 21.5, true},
+		{nest.ThermostatModeCool, 19, true},
+	}
+	for _, test := range tests {
+		useMockNestClient(t, ambientDevice("device", test.mode, test.ambient))
+		job := BoostJob{DeviceID: "device", Temperature: 21, Delta: 0.5, Boosted: nest.Setpoint{Mode: test.mode}}
+		reached, err := targetReached(staticTokenSource{}, job)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reached != test.reached {
+			t.Errorf("Expected reached to be %t in %s mode at %.1f°C", test.reached, test.mode, test.ambient)
+		}
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	oldPollInterval, oldMaxPollInterval := pollInterval, maxPollInterval
+	t.Cleanup(func() { pollInterval, maxPollInterval = oldPollInterval, oldMaxPollInterval })
+	pollInterval, maxPollInterval = time.Minute, time.Minute*3
+
+	interval := nextPollInterval(pollInterval, &nest.RateLimitError{})
+	if interval != time.Minute*2 {
+		t.Errorf("Expected the interval to double when rate limited, got %s", interval)
+	}
+	interval = nextPollInterval(interval, &nest.RateLimitError{})
+	if interval != maxPollInterval {
+		t.Errorf("Expected the interval to be capped at %s, got %s", maxPollInterval, interval)
+	}
+	if interval = nextPollInterval(interval, nest.ErrUnavailable); interval != maxPollInterval {
+		t.Errorf("Expected other errors to keep the interval, got %s", interval)
+	}
+	if interval = nextPollInterval(interval, nil); interval != pollInterval {
+		t.Errorf("Expected the interval to be reset after a successful check, got %s", interval)
+	}
+}
+
+func TestBoostUntilReached(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	mock := useMockNestClient(t, ambientDevice("device", nest.ThermostatModeHeat, 20.6))
+	oldAccessTokens, oldPollInterval := accessTokens, pollInterval
+	t.Cleanup(func() { accessTokens, pollInterval = oldAccessTokens, oldPollInterval })
+	accessTokens = newTokenManager(func(string) (*Token, error) { return staticTokenSource{}.Token() }, nil)
+	pollInterval = time.Millisecond
+
+	job, err := startBoost("household", Token{AccessToken: "token"}, BoostRequest{DeviceID: "device", Temperature: 21, Duration: 60, UntilReached: true, Delta: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to start boost: %s", err)
+	}
+	// The first checks are rate limited, and are tried again
+	mock.mu.Lock()
+	mock.getErrors = []error{&nest.RateLimitError{}, &nest.RateLimitError{}}
+	mock.mu.Unlock()
+	waitForBoostsToEnd(t)
+	if len(mock.getErrors) != 0 {
+		t.Errorf("Expected the temperature to be checked again after being rate limited")
+	}
+
+	entries := store.History(HistoryFilter{})
+	if len(entries) != 1 || entries[0].ID != job.ID {
+		t.Fatalf("Expected the boost in the history, got %v", entries)
+	}
+	if !entries[0].TargetReached || !entries[0].End.Before(job.End) {
+		t.Errorf("Expected the boost to end early once the target was reached, got %+v", entries[0])
+	}
+}
@@ -0,0 +1,40 @@
+// Command fakesdm runs the fake Smart Device Management and OAuth server, for
+// trying out the app without a Google account. Start the app with:
+//
+//	SDM_BASE_URL=http://localhost:8081 \
+//	OAUTH_TOKEN_URL=http://localhost:8081/token \
+//	PARTNER_CONNECTIONS_URL=http://localhost:8081 \
+//	PROJECT_ID=fake-project
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/andyfoston/nest-heating-boost/fakesdm"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	projectID := flag.String("project", "fake-project", "device access project ID")
+	flag.Parse()
+
+	server := fakesdm.New(*projectID)
+	server.AcceptAnyCode = true
+	server.AddDevice(fakesdm.Device{
+		ID:             "thermostat-1",
+		DisplayName:    "Hallway",
+		HeatCelsius:    18,
+		AmbientCelsius: 17.5,
+	})
+	server.AddDevice(fakesdm.Device{
+		ID:             "thermostat-2",
+		DisplayName:    "Upstairs",
+		Mode:           fakesdm.ModeOff,
+		HeatCelsius:    17,
+		AmbientCelsius: 16,
+	})
+	log.Printf("Fake SDM server listening on %s for project %s", *addr, *projectID)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+)
+
+const (
+	// csrfKey holds the token in the cookie which forms must send back in the
+	// csrf field, so that other sites can't submit them as the user
+	csrfKey   = "csrf"
+	csrfField = "csrf"
+)
+
+// csrfToken returns the token to add to forms, adding it to the cookie if
+// needed. This must be called before writing the response.
+func csrfToken(w http.ResponseWriter, data map[string]string) string {
+	if token := data[csrfKey]; token != "" {
+		return token
+	}
+	data[csrfKey] = newID()
+	if err := setCookie(data, w); err != nil {
+		log.Printf("Failed to set cookie: %s", err)
+	}
+	return data[csrfKey]
+}
+
+// checkCSRF reports whether the form was posted with the token in the cookie.
+// If not, it flashes an error for the caller to redirect with.
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	token := data[csrfKey]
+	if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue(csrfField))) == 1 {
+		return true
+	}
+	log.Printf("Rejected %s without a valid CSRF token", r.URL.Path)
+	flash.SetFlashes(w, []flash.Flash{{
+		Level:   flash.WARN,
+		Message: "The page had expired, so nothing was changed. Please try again",
+	}})
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+type cachedDevices struct {
+	devices *nest.Devices
+	fetched time.Time
+}
+
+// deviceCache keeps each user's list of devices and their traits for a short
+// time, so that loading a page doesn't use up the quota for the SDM API. It's
+// cleared for a device whenever a command changes it.
+type deviceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedDevices
+	now     func() time.Time
+}
+
+func newDeviceCache(ttl time.Duration) *deviceCache {
+	return &deviceCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedDevices),
+		now:     time.Now,
+	}
+}
+
+// Devices returns the user's devices and when they were fetched from Google.
+// If the user is rate limited, devices past their TTL are returned rather
+// than nothing.
+func (c *deviceCache) Devices(householdID string, token Token) (*nest.Devices, time.Time, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[householdID]
+	c.mu.Unlock()
+	if ok && c.now().Sub(cached.fetched) < c.ttl {
+		return cached.devices, cached.fetched, nil
+	}
+
+	devices, err := nestClient.ListDevices(token.AccessToken)
+	if err != nil {
+		if ok && errors.Is(err, nest.ErrRateLimit) {
+			log.Printf("Rate limited listing devices, using devices from %s", cached.fetched)
+			return cached.devices, cached.fetched, nil
+		}
+		return devices, time.Time{}, err
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.entries {
+		if now.Sub(entry.fetched) >= c.ttl {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[householdID] = cachedDevices{devices: devices, fetched: now}
+	return devices, now, nil
+}
+
+// Refresh drops the user's devices so they're fetched again on the next load
+func (c *deviceCache) Refresh(householdID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, householdID)
+}
+
+// Invalidate drops every user's devices which include the device, as they all
+// share it
+func (c *deviceCache) Invalidate(deviceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		for _, device := range entry.devices.Devices {
+			if device.DeviceID() == deviceID {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// invalidatingClient is a nest.Client which clears the cached devices after a
+// command changes a device
+type invalidatingClient struct {
+	nest.Client
+	cache *deviceCache
+}
+
+func (c invalidatingClient) ExecuteCommand(accessToken, deviceID string, command nest.ExecuteCommandRequest) error {
+	err := c.Client.ExecuteCommand(accessToken, deviceID, command)
+	if err == nil {
+		c.cache.Invalidate(deviceID)
+	}
+	return err
+}
+
+func refreshDevices(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if !checkCSRF(w, r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	if householdID, ok := authorizedHouseholdFromCookie(w, data); ok {
+		devicesCache.Refresh(householdID)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+// countingNestClient counts the calls to list devices, optionally failing them
+type countingNestClient struct {
+	*mockNestClient
+	lists int
+	err   error
+}
+
+func (c *countingNestClient) ListDevices(accessToken string) (*nest.Devices, error) {
+	c.lists++
+	if c.err != nil {
+		return &nest.Devices{}, c.err
+	}
+	return c.mockNestClient.ListDevices(accessToken)
+}
+
+func newTestDeviceCache(t *testing.T) (*deviceCache, *countingNestClient, *time.Time) {
+	mock := useMockNestClient(t, heatDevice("device-1", nest.ThermostatModeHeat, nest.EcoModeOff, 18))
+	counting := &countingNestClient{mockNestClient: mock}
+	cache := newDeviceCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	nestClient = invalidatingClient{Client: counting, cache: cache}
+	return cache, counting, &now
+}
+
+func TestDeviceCacheTTL(t *testing.T) {
+	cache, client, now := newTestDeviceCache(t)
+	for i := 0; i < 2; i++ {
+		devices, _, err := cache.Devices("refresh-token", Token{})
+		if err != nil || len(devices.Devices) != 1 {
+			t.Fatalf("Expected a device, got %v %v", devices, err)
+		}
+	}
+	if client.lists != 1 {
+		t.Errorf("Expected the devices to be listed once, got %d", client.lists)
+	}
+
+	cache.Devices("other-refresh-token", Token{})
+	if client.lists != 2 {
+		t.Errorf("Expected devices to be cached per user, got %d lists", client.lists)
+	}
+
+	*now = now.Add(time.Minute)
+	cache.Devices("refresh-token", Token{})
+	if client.lists != 3 {
+		t.Errorf("Expected the devices to be listed again after the TTL, got %d lists", client.lists)
+	}
+}
+
+func TestDeviceCacheInvalidatedByCommand(t *testing.T) {
+	cache, client, _ := newTestDeviceCache(t)
+	cache.Devices("refresh-token", Token{})
+	err := nest.SetSetpoint(nestClient, "token", "device-1", nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 21})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cache.Devices("refresh-token", Token{})
+	if client.lists != 2 {
+		t.Errorf("Expected the devices to be listed again after a command, got %d lists", client.lists)
+	}
+
+	cache.Refresh("refresh-token")
+	cache.Devices("refresh-token", Token{})
+	if client.lists != 3 {
+		t.Errorf("Expected the devices to be listed again after a refresh, got %d lists", client.lists)
+	}
+}
+
+func TestDeviceCacheStaleWhenRateLimited(t *testing.T) {
+	cache, client, now := newTestDeviceCache(t)
+	_, fetched, _ := cache.Devices("refresh-token", Token{})
+	*now = now.Add(time.Hour)
+	client.err = nest.ErrRateLimit
+
+	devices, updated, err := cache.Devices("refresh-token", Token{})
+	if err != nil || len(devices.Devices) != 1 || !updated.Equal(fetched) {
+		t.Errorf("Expected the stale devices when rate limited, got %v %v", devices, err)
+	}
+	_, _, err = cache.Devices("other-refresh-token", Token{})
+	if err != nest.ErrRateLimit {
+		t.Errorf("Expected ErrRateLimit with nothing cached, got %v", err)
+	}
+}
@@ -0,0 +1,446 @@
+// Package fakesdm is a fake of the Google Smart Device Management API, along
+// with the OAuth endpoints used to authorize access to it. It keeps thermostats
+// in memory so the boost flow can be tested without a network connection.
+package fakesdm
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	ModeHeat     = "HEAT"
+	ModeCool     = "COOL"
+	ModeHeatCool = "HEATCOOL"
+	ModeOff      = "OFF"
+
+	EcoManual = "MANUAL_ECO"
+	EcoOff    = "OFF"
+)
+
+// Device is a thermostat held by the fake server
+type Device struct {
+	ID          string
+	DisplayName string
+	Mode        string
+	EcoMode     string
+	HeatCelsius float32
+	CoolCelsius float32
+	// AmbientCelsius is the temperature of the room the thermostat is in
+	AmbientCelsius float32
+	Offline        bool
+}
+
+// Command is an executeCommand request received by the server
+type Command struct {
+	DeviceID string                 `json:"-"`
+	Command  string                 `json:"command"`
+	Params   map[string]interface{} `json:"params"`
+}
+
+type Server struct {
+	ProjectID string
+	// AcceptAnyCode allows any authorization code to be exchanged for a token
+	AcceptAnyCode bool
+	// AuthorizeError is redirected back with instead of a code if set, as if
+	// the user had declined on the consent screen
+	AuthorizeError string
+
+	mu      sync.Mutex
+	devices []*Device
+	codes   map[string]string
+	// challenges are the PKCE code challenges sent when codes were issued
+	challenges    map[string]string
+	refreshTokens map[string]bool
+	accessTokens  map[string]bool
+	issued        int
+	rateLimited   int
+	commands      []Command
+}
+
+func New(projectID string) *Server {
+	return &Server{
+		ProjectID:     projectID,
+		codes:         make(map[string]string),
+		challenges:    make(map[string]string),
+		refreshTokens: make(map[string]bool),
+		accessTokens:  make(map[string]bool),
+	}
+}
+
+// AddDevice adds a thermostat to the server
+func (s *Server) AddDevice(device Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device.Mode == "" {
+		device.Mode = ModeHeat
+	}
+	if device.EcoMode == "" {
+		device.EcoMode = EcoOff
+	}
+	s.devices = append(s.devices, &device)
+}
+
+// Device returns the current state of a thermostat
+func (s *Server) Device(id string) (Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device := s.findDevice(id)
+	if device == nil {
+		return Device{}, false
+	}
+	return *device, true
+}
+
+// UpdateDevice changes a thermostat, as if someone had changed it by hand
+func (s *Server) UpdateDevice(id string, update func(device *Device)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device := s.findDevice(id); device != nil {
+		update(device)
+	}
+}
+
+// AddAuthCode allows an authorization code to be exchanged for the refresh token
+func (s *Server) AddAuthCode(code, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = refreshToken
+	s.refreshTokens[refreshToken] = true
+}
+
+// AddRefreshToken allows a refresh token to be exchanged for access tokens
+func (s *Server) AddRefreshToken(refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshTokens[refreshToken] = true
+}
+
+// RevokeRefreshToken simulates a user removing access in their Google account
+func (s *Server) RevokeRefreshToken(refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refreshTokens, refreshToken)
+}
+
+// ExpireAccessTokens rejects every access token issued so far, as Google does
+// once they've expired
+func (s *Server) ExpireAccessTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTokens = make(map[string]bool)
+}
+
+// RateLimit causes the next n requests to the SDM API to be rejected with a 429
+func (s *Server) RateLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited = n
+}
+
+// Commands returns the commands executed so far
+func (s *Server) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commands := make([]Command, len(s.commands))
+	copy(commands, s.commands)
+	return commands
+}
+
+func (s *Server) findDevice(id string) *Device {
+	for _, device := range s.devices {
+		if device.ID == id {
+			return device
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/token":
+		s.token(w, r)
+	case strings.HasPrefix(r.URL.Path, "/partnerconnections/"):
+		s.authorize(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/enterprises/"):
+		s.sdm(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize skips the consent screen and redirects straight back with a code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values := url.Values{"code": {"fake-code"}}
+	s.mu.Lock()
+	if s.AuthorizeError != "" {
+		values = url.Values{"error": {s.AuthorizeError}}
+	}
+	s.mu.Unlock()
+	if challenge := query.Get("code_challenge"); challenge != "" {
+		if query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "unsupported code_challenge_method", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.challenges["fake-code"] = challenge
+		s.mu.Unlock()
+	}
+	if state := query.Get("state"); state != "" {
+		values.Set("state", state)
+	}
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	// Like Google, the credentials are only read from the body
+	r.ParseForm()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refreshToken string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		token, ok := s.codes[code]
+		if !ok && s.AcceptAnyCode && code != "" {
+			token, ok = "refresh-"+code, true
+			s.refreshTokens[token] = true
+		}
+		if !ok {
+			writeTokenError(w, "invalid_grant", "Malformed auth code.")
+			return
+		}
+		if challenge, ok := s.challenges[code]; ok {
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				writeTokenError(w, "invalid_grant", "Invalid code verifier.")
+				return
+			}
+			delete(s.challenges, code)
+		}
+		delete(s.codes, code)
+		refreshToken = token
+	case "refresh_token":
+		refreshToken = r.PostForm.Get("refresh_token")
+		if !s.refreshTokens[refreshToken] {
+			writeTokenError(w, "invalid_grant", "Token has been expired or revoked.")
+			return
+		}
+	default:
+		writeTokenError(w, "unsupported_grant_type", "Invalid grant_type: "+r.PostForm.Get("grant_type"))
+		return
+	}
+	s.issued++
+	accessToken := fmt.Sprintf("access-%d", s.issued)
+	s.accessTokens[accessToken] = true
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"expires_in":   3599,
+		"scope":        "https://www.googleapis.com/auth/sdm.service",
+		"token_type":   "Bearer",
+	}
+	if r.PostForm.Get("grant_type") == "authorization_code" {
+		response["refresh_token"] = refreshToken
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) sdm(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		writeError(w, http.StatusTooManyRequests, "RESOURCE_EXHAUSTED", "Rate limited.")
+		return
+	}
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !s.accessTokens[accessToken] {
+		writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "Request had invalid authentication credentials.")
+		return
+	}
+
+	prefix := fmt.Sprintf("/v1/enterprises/%s/devices", s.ProjectID)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusForbidden, "PERMISSION_DENIED", "Permission denied.")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		devices := make([]interface{}, 0, len(s.devices))
+		for _, device := range s.devices {
+			devices = append(devices, s.deviceJSON(device))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": devices})
+	case strings.HasSuffix(path, ":executeCommand") && r.Method == http.MethodPost:
+		s.executeCommand(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/"), ":executeCommand"))
+	case strings.HasPrefix(path, "/") && r.Method == http.MethodGet:
+		device := s.findDevice(strings.TrimPrefix(path, "/"))
+		if device == nil {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Device not found.")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.deviceJSON(device))
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Not found.")
+	}
+}
+
+func (s *Server) executeCommand(w http.ResponseWriter, r *http.Request, deviceID string) {
+	device := s.findDevice(deviceID)
+	if device == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Device not found.")
+		return
+	}
+	if device.Offline {
+		writeError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "Thermostat is offline.")
+		return
+	}
+	command := Command{DeviceID: deviceID}
+	err := json.NewDecoder(r.Body).Decode(&command)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid command.")
+		return
+	}
+
+	heat, hasHeat := command.Params["heatCelsius"].(float64)
+	cool, hasCool := command.Params["coolCelsius"].(float64)
+	mode, _ := command.Params["mode"].(string)
+	switch command.Command {
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat":
+		if !s.setpointAllowed(w, device, ModeHeat) || !requireParam(w, hasHeat) {
+			return
+		}
+		device.HeatCelsius = float32(heat)
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool":
+		if !s.setpointAllowed(w, device, ModeCool) || !requireParam(w, hasCool) {
+			return
+		}
+		device.CoolCelsius = float32(cool)
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange":
+		if !s.setpointAllowed(w, device, ModeHeatCool) || !requireParam(w, hasHeat && hasCool) {
+			return
+		}
+		device.HeatCelsius = float32(heat)
+		device.CoolCelsius = float32(cool)
+	case "sdm.devices.commands.ThermostatMode.SetMode":
+		if mode != ModeHeat && mode != ModeCool && mode != ModeHeatCool && mode != ModeOff {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid mode.")
+			return
+		}
+		device.Mode = mode
+	case "sdm.devices.commands.ThermostatEco.SetMode":
+		if mode != EcoManual && mode != EcoOff {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid eco mode.")
+			return
+		}
+		device.EcoMode = mode
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Unknown command.")
+		return
+	}
+	s.commands = append(s.commands, command)
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// setpointAllowed checks the thermostat is in a mode which accepts the command
+func (s *Server) setpointAllowed(w http.ResponseWriter, device *Device, mode string) bool {
+	if device.EcoMode == EcoManual || device.Mode != mode {
+		writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", fmt.Sprintf("Command not allowed in current thermostat mode: %s.", device.Mode))
+		return false
+	}
+	return true
+}
+
+func requireParam(w http.ResponseWriter, ok bool) bool {
+	if !ok {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Missing temperature.")
+	}
+	return ok
+}
+
+func (s *Server) deviceJSON(device *Device) map[string]interface{} {
+	setpoint := map[string]interface{}{}
+	if device.EcoMode != EcoManual {
+		switch device.Mode {
+		case ModeHeat:
+			setpoint["heatCelsius"] = device.HeatCelsius
+		case ModeCool:
+			setpoint["coolCelsius"] = device.CoolCelsius
+		case ModeHeatCool:
+			setpoint["heatCelsius"] = device.HeatCelsius
+			setpoint["coolCelsius"] = device.CoolCelsius
+		}
+	}
+	connectivity := "ONLINE"
+	if device.Offline {
+		connectivity = "OFFLINE"
+	}
+	room := fmt.Sprintf("enterprises/%s/structures/structure/rooms/%s", s.ProjectID, device.ID)
+	return map[string]interface{}{
+		"name":     fmt.Sprintf("enterprises/%s/devices/%s", s.ProjectID, device.ID),
+		"type":     "sdm.devices.types.THERMOSTAT",
+		"assignee": room,
+		"traits": map[string]interface{}{
+			"sdm.devices.traits.Info":         map[string]interface{}{"customName": ""},
+			"sdm.devices.traits.Humidity":     map[string]interface{}{"ambientHumidityPercent": 50},
+			"sdm.devices.traits.Connectivity": map[string]interface{}{"status": connectivity},
+			"sdm.devices.traits.Fan":          map[string]interface{}{},
+			"sdm.devices.traits.ThermostatMode": map[string]interface{}{
+				"mode":           device.Mode,
+				"availableModes": []string{ModeHeat, ModeCool, ModeHeatCool, ModeOff},
+			},
+			"sdm.devices.traits.ThermostatEco": map[string]interface{}{
+				"availableModes": []string{EcoOff, EcoManual},
+				"mode":           device.EcoMode,
+				"heatCelsius":    12.5,
+				"coolCelsius":    24.5,
+			},
+			"sdm.devices.traits.ThermostatHvac":                map[string]interface{}{"status": "OFF"},
+			"sdm.devices.traits.Settings":                      map[string]interface{}{"temperatureScale": "CELSIUS"},
+			"sdm.devices.traits.ThermostatTemperatureSetpoint": setpoint,
+			"sdm.devices.traits.Temperature":                   map[string]interface{}{"ambientTemperatureCelsius": device.AmbientCelsius},
+		},
+		"parentRelations": []map[string]interface{}{
+			{"parent": room, "displayName": device.DisplayName},
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error in the format used by Google APIs
+func writeError(w http.ResponseWriter, code int, status string, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
+
+// writeTokenError writes an error in the format used by the OAuth token endpoint
+func writeTokenError(w http.ResponseWriter, code string, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":             code,
+		"error_description": description,
+	})
+}
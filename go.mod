@@ -2,6 +2,9 @@ module github.com/andyfoston/nest-heating-boost
 
 go 1.21.5
 
-require github.com/gorilla/securecookie v1.1.2
+require (
+	github.com/gorilla/securecookie v1.1.2
+	golang.org/x/crypto v0.9.0
+)
 
 replace github.com/andyfoston/nest-heating-boost/flash => ./flash
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+)
+
+type BoostOutcome string
+
+const (
+	OutcomeRunning  BoostOutcome = "running"
+	OutcomeReverted BoostOutcome = "reverted"
+	// OutcomeSkipped is used when the temperature was changed by someone else
+	// during the boost, so the original temperature was not restored
+	OutcomeSkipped  BoostOutcome = "skipped"
+	OutcomeReplaced BoostOutcome = "replaced"
+	OutcomeFailed   BoostOutcome = "failed"
+)
+
+// maxHistory is the number of history entries kept in the store
+const maxHistory = 1000
+
+// HistoryEntry is the audit record of a single boost. HouseholdID is the
+// household which asked for the boost.
+type HistoryEntry struct {
+	ID                   string       `json:"id"`
+	HouseholdID          string       `json:"householdId"`
+	DeviceID             string       `json:"deviceId"`
+	RequestedBy          string       `json:"requestedBy"`
+	RequestedTemperature float32      `json:"requestedTemperature"`
+	Mode                 string       `json:"mode"`
+	Duration             int          `json:"duration"`
+	OriginalTemperature  float32      `json:"originalTemperature"`
+	Start                time.Time    `json:"start"`
+	End                  time.Time    `json:"end"`
+	Cancelled            bool         `json:"cancelled"`
+	UntilReached         bool         `json:"untilReached"`
+	TargetReached        bool         `json:"targetReached"`
+	Outcome              BoostOutcome `json:"outcome"`
+	Error                string       `json:"error,omitempty"`
+}
+
+func (h *HistoryEntry) GetClass() string {
+	switch h.Outcome {
+	case OutcomeFailed:
+		return "table-danger"
+	case OutcomeSkipped:
+		return "table-warning"
+	case OutcomeRunning:
+		return "table-info"
+	default:
+		return ""
+	}
+}
+
+// HistoryFilter restricts the history returned. Zero values match everything.
+type HistoryFilter struct {
+	// HouseholdID limits the history to a household's boosts, if set
+	HouseholdID string
+	DeviceID    string
+	From        time.Time
+	To          time.Time
+}
+
+func (f *HistoryFilter) Matches(entry *HistoryEntry) bool {
+	if f.HouseholdID != "" && entry.HouseholdID != f.HouseholdID {
+		return false
+	}
+	if f.DeviceID != "" && entry.DeviceID != f.DeviceID {
+		return false
+	}
+	if !f.From.IsZero() && entry.Start.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Start.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// parseHistoryFilter reads the device, from and to query parameters. Dates are
+// in the format YYYY-MM-DD and both ends of the range are inclusive.
+func parseHistoryFilter(r *http.Request) (HistoryFilter, error) {
+	query := r.URL.Query()
+	filter := HistoryFilter{DeviceID: query.Get("device")}
+	if from := query.Get("from"); from != "" {
+		date, err := time.ParseInLocation(time.DateOnly, from, time.Local)
+		if err != nil {
+			return filter, err
+		}
+		filter.From = date
+	}
+	if to := query.Get("to"); to != "" {
+		date, err := time.ParseInLocation(time.DateOnly, to, time.Local)
+		if err != nil {
+			return filter, err
+		}
+		filter.To = date.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// recordHistory updates the history entry for a boost, logging any failure
+func recordHistory(id string, update func(entry *HistoryEntry)) {
+	err := store.UpdateHistory(id, update)
+	if err != nil {
+		log.Printf("Failed to update history for boost %s: %s", id, err)
+	}
+}
+
+func historyPage(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := householdFromRequest(w, r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	files := []string{
+		"./templates/base.tmpl",
+		"./templates/history.tmpl",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		log.Printf("Unable to parse files: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	flashes, err := flash.GetFlashes(w, r)
+	if err != nil {
+		log.Printf("Failed to get flashes: %s\n", err)
+	}
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.ERROR,
+			Message: "Dates must be in the format YYYY-MM-DD",
+		})
+	}
+	filter.HouseholdID = householdID
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{
+		"Flashes": flashes,
+		"History": store.History(filter),
+		"Query":   r.URL.Query(),
+	})
+	if err != nil {
+		log.Printf("Failed to execute template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func historyJSON(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := householdFromRequest(w, r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, "Dates must be in the format YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	filter.HouseholdID = householdID
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(store.History(filter))
+	if err != nil {
+		log.Printf("Failed to write history: %s\n", err)
+	}
+}
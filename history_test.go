@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryFilterMatches(t *testing.T) {
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	entry := HistoryEntry{ID: "abc", HouseholdID: "household", DeviceID: "device", Start: start}
+
+	tests := []struct {
+		filter   HistoryFilter
+		expected bool
+	}{
+		{HistoryFilter{}, true},
+		{HistoryFilter{HouseholdID: "household"}, true},
+		{HistoryFilter{HouseholdID: "other-household"}, false},
+		{HistoryFilter{DeviceID: "device"}, true},
+		{HistoryFilter{DeviceID: "other"}, false},
+		{HistoryFilter{From: start.Add(-time.Hour)}, true},
+		{HistoryFilter{From: start.Add(time.Hour)}, false},
+		{HistoryFilter{To: start.Add(time.Hour)}, true},
+		{HistoryFilter{To: start}, false},
+	}
+	for _, test := range tests {
+		if test.filter.Matches(&entry) != test.expected {
+			t.Errorf("Expected %v for filter %v", test.expected, test.filter)
+		}
+	}
+}
+
+func TestParseHistoryFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/history?device=abc&from=2024-01-10&to=2024-01-11", nil)
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %s", err)
+	}
+	if filter.DeviceID != "abc" {
+		t.Errorf("Expected device abc, got %s", filter.DeviceID)
+	}
+	if !filter.From.Equal(time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected from date: %s", filter.From)
+	}
+	// The to date is inclusive
+	if !filter.To.Equal(time.Date(2024, 1, 12, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected to date: %s", filter.To)
+	}
+}
+
+func TestParseHistoryFilterInvalidDate(t *testing.T) {
+	r := httptest.NewRequest("GET", "/history?from=yesterday", nil)
+	_, err := parseHistoryFilter(r)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid date")
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	s.AddHistory(HistoryEntry{ID: "a", DeviceID: "device", Outcome: OutcomeRunning})
+	s.AddHistory(HistoryEntry{ID: "b", DeviceID: "other", Outcome: OutcomeRunning})
+	err = s.UpdateHistory("a", func(entry *HistoryEntry) {
+		entry.Outcome = OutcomeSkipped
+	})
+	if err != nil {
+		t.Fatalf("Failed to update history: %s", err)
+	}
+
+	entries := s.History(HistoryFilter{})
+	if len(entries) != 2 || entries[0].ID != "b" {
+		t.Fatalf("Expected newest entry first, got %v", entries)
+	}
+	entries = s.History(HistoryFilter{DeviceID: "device"})
+	if len(entries) != 1 || entries[0].Outcome != OutcomeSkipped {
+		t.Errorf("Expected the updated entry, got %v", entries)
+	}
+	if s.UpdateHistory("missing", func(entry *HistoryEntry) {}) == nil {
+		t.Errorf("Expected an error updating a missing entry")
+	}
+}
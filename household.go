@@ -0,0 +1,493 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+)
+
+// Role decides what a user can do in their household
+type Role string
+
+const (
+	// RoleAdmin can authorize access to Nest and invite others
+	RoleAdmin Role = "admin"
+	// RoleMember can only boost
+	RoleMember Role = "member"
+
+	// userKey holds the ID of the signed in user in the cookie
+	userKey = "user"
+
+	// inviteExpiry is how long a login link can be used for
+	inviteExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInviteNotFound = errors.New("the invite has expired or already been used")
+	ErrUserNotFound   = errors.New("no such user in the household")
+	ErrRemoveSelf     = errors.New("you can't remove yourself from the household")
+)
+
+// User is someone who can boost the thermostats of their household. Everyone
+// in a household shares the access to Nest authorized by one of its admins,
+// which the vault keeps under the household's ID, so members never see the
+// Google consent screen.
+type User struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Role        Role      `json:"role"`
+	HouseholdID string    `json:"householdId"`
+	Created     time.Time `json:"created"`
+	// Username is used to log in with a password, or by a reverse proxy
+	Username     string `json:"username,omitempty"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	// OIDCSubject identifies the user with the OpenID Connect provider
+	OIDCSubject string `json:"oidcSubject,omitempty"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// Invite is a login link for someone to join a household
+type Invite struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Role        Role      `json:"role"`
+	HouseholdID string    `json:"householdId"`
+	InvitedBy   string    `json:"invitedBy"`
+	Expires     time.Time `json:"expires"`
+}
+
+// newUser adds a user to a household
+func newUser(name string, role Role, householdID string) (*User, error) {
+	user := User{
+		ID:          newID(),
+		Name:        name,
+		Role:        role,
+		HouseholdID: householdID,
+		Created:     time.Now(),
+	}
+	err := store.PutUser(&user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save user: %w", err)
+	}
+	return &user, nil
+}
+
+// inviteUser creates a login link for someone to join the admin's household
+func inviteUser(admin *User, name string, role Role) (*Invite, error) {
+	if role != RoleAdmin && role != RoleMember {
+		return nil, fmt.Errorf("unknown role: %s", role)
+	}
+	invite := Invite{
+		ID:          newID(),
+		Name:        name,
+		Role:        role,
+		HouseholdID: admin.HouseholdID,
+		InvitedBy:   admin.Name,
+		Expires:     time.Now().Add(inviteExpiry),
+	}
+	err := store.PutInvite(&invite)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save invite: %w", err)
+	}
+	return &invite, nil
+}
+
+// acceptInvite adds the person invited to the household, logging in with the
+// username or OIDC subject in login. A password is needed unless they log in
+// through the OpenID Connect provider or a reverse proxy. Each invite can only
+// be used once.
+func acceptInvite(id string, login User, password string) (*User, error) {
+	var hash string
+	if password != "" {
+		var err error
+		hash, err = hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	if err := checkUsernameFree(login.Username, ""); err != nil {
+		return nil, err
+	}
+	invite, err := store.DeleteInvite(id)
+	if err != nil {
+		log.Printf("Failed to remove invite: %s", err)
+	}
+	if invite == nil || time.Now().After(invite.Expires) {
+		return nil, ErrInviteNotFound
+	}
+	user := User{
+		ID:           newID(),
+		Name:         invite.Name,
+		Role:         invite.Role,
+		HouseholdID:  invite.HouseholdID,
+		Created:      time.Now(),
+		Username:     login.Username,
+		PasswordHash: hash,
+		OIDCSubject:  login.OIDCSubject,
+	}
+	err = store.PutUser(&user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save user: %w", err)
+	}
+	return &user, nil
+}
+
+// removeUser removes someone else from the admin's household
+func removeUser(admin *User, id string) error {
+	if id == admin.ID {
+		return ErrRemoveSelf
+	}
+	user, ok := store.User(id)
+	if !ok || user.HouseholdID != admin.HouseholdID {
+		return ErrUserNotFound
+	}
+	_, err := store.DeleteUser(id)
+	return err
+}
+
+// cancelInvite removes an invite to the admin's household before it's used
+func cancelInvite(admin *User, id string) error {
+	for _, invite := range store.Invites() {
+		if invite.ID == id && invite.HouseholdID == admin.HouseholdID {
+			_, err := store.DeleteInvite(id)
+			return err
+		}
+	}
+	return ErrInviteNotFound
+}
+
+// householdUsers returns the users in a household, oldest first
+func householdUsers(householdID string) []User {
+	users := make([]User, 0)
+	for _, user := range store.Users() {
+		if user.HouseholdID == householdID {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+	return users
+}
+
+// householdInvites returns the invites to a household which can still be used,
+// soonest to expire first
+func householdInvites(householdID string) []Invite {
+	invites := make([]Invite, 0)
+	for _, invite := range store.Invites() {
+		if invite.HouseholdID == householdID && time.Now().Before(invite.Expires) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Expires.Before(invites[j].Expires)
+	})
+	return invites
+}
+
+// userFromCookie returns the user signed in with the cookie. A cookie from
+// before the vault, holding a refresh token, signs in as the admin of a new
+// household for that refresh token. This must be called before writing the
+// response, as the cookie may be updated.
+func userFromCookie(w http.ResponseWriter, data map[string]string) (*User, bool) {
+	if user, ok := store.User(data[userKey]); ok {
+		return user, true
+	}
+	refreshToken := data[refreshTokenKey]
+	if refreshToken == "" {
+		return nil, false
+	}
+	householdID, err := vault.Import(refreshToken)
+	if err != nil {
+		log.Printf("Failed to move refresh token from cookie into the vault: %s", err)
+		return nil, false
+	}
+	user, err := newUser("Admin", RoleAdmin, householdID)
+	if err != nil {
+		log.Printf("Failed to add user for household: %s", err)
+		return nil, false
+	}
+	if err := signIn(w, data, user); err != nil {
+		log.Printf("Failed to set cookie: %s", err)
+	}
+	return user, true
+}
+
+// authorizedHouseholdFromCookie returns the household of the user signed in
+// with the cookie, and whether the household has access to Nest.
+func authorizedHouseholdFromCookie(w http.ResponseWriter, data map[string]string) (string, bool) {
+	user, ok := userFromCookie(w, data)
+	if !ok {
+		return "", false
+	}
+	return user.HouseholdID, vault.Has(user.HouseholdID)
+}
+
+// householdFromRequest returns the household of the user signed in with the
+// request's cookie
+func householdFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	user, ok := userFromCookie(w, data)
+	if !ok {
+		return "", false
+	}
+	return user.HouseholdID, true
+}
+
+// requestedBy returns who to record a boost as requested by
+func requestedBy(r *http.Request, user *User) string {
+	if user == nil || user.Name == "" {
+		return r.RemoteAddr
+	}
+	return user.Name
+}
+
+// inviteURL returns the login link for an invite
+func inviteURL(r *http.Request, invite Invite) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/join?invite=%s", scheme, r.Host, invite.ID)
+}
+
+// InviteView is an invite as shown on the household page
+type InviteView struct {
+	Invite
+	URL string
+}
+
+// adminFromCookie returns the signed in user if they're an admin. Otherwise it
+// redirects them and returns false.
+func adminFromCookie(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	user, ok := userFromCookie(w, data)
+	if !ok {
+		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+		return nil, false
+	}
+	if !user.IsAdmin() {
+		flash.SetFlashes(w, []flash.Flash{{
+			Level:   flash.WARN,
+			Message: "Only an admin of your household can manage who's in it",
+		}})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil, false
+	}
+	return user, true
+}
+
+func householdPage(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminFromCookie(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/household", http.StatusSeeOther)
+			return
+		}
+		flashes := make([]flash.Flash, 0, 1)
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.ERROR,
+				Message: "Unable to invite someone without a name",
+			})
+		} else if _, err := inviteUser(admin, name, Role(r.FormValue("role"))); err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Failed to invite %s: %s", name, err),
+			})
+		} else {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: fmt.Sprintf("Invited %s. Send them their login link below", name),
+			})
+		}
+		flash.SetFlashes(w, flashes)
+		http.Redirect(w, r, "/household", http.StatusSeeOther)
+		return
+	}
+
+	files := []string{
+		"./templates/base.tmpl",
+		"./templates/household.tmpl",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		log.Printf("Unable to parse files: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	flashes, err := flash.GetFlashes(w, r)
+	if err != nil {
+		log.Printf("Failed to get flashes: %s\n", err)
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	invites := make([]InviteView, 0)
+	for _, invite := range householdInvites(admin.HouseholdID) {
+		invites = append(invites, InviteView{Invite: invite, URL: inviteURL(r, invite)})
+	}
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{
+		"Flashes": flashes,
+		"User":    admin,
+		"Users":   householdUsers(admin.HouseholdID),
+		"Invites": invites,
+		"CSRF":    csrfToken(w, data),
+	})
+	if err != nil {
+		log.Printf("Failed to execute template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// householdAction handles the buttons shown against each user and invite
+func householdAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin, ok := adminFromCookie(w, r)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	defer http.Redirect(w, r, "/household", http.StatusSeeOther)
+	if !checkCSRF(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	var message string
+	var err error
+	switch r.URL.Path {
+	case "/household/remove":
+		err = removeUser(admin, id)
+		message = "Removed from the household"
+	case "/household/uninvite":
+		err = cancelInvite(admin, id)
+		message = "Invite cancelled"
+	}
+	flashes := make([]flash.Flash, 0, 1)
+	if err != nil {
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.WARN,
+			Message: fmt.Sprintf("Unable to update the household: %s", err),
+		})
+	} else {
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.INFO,
+			Message: message,
+		})
+	}
+	err = flash.SetFlashes(w, flashes)
+	if err != nil {
+		log.Printf("Failed to set flash: %s\n", err)
+	}
+}
+
+// findInvite returns an invite which can still be used
+func findInvite(id string) (*Invite, bool) {
+	for _, invite := range store.Invites() {
+		if invite.ID == id && time.Now().Before(invite.Expires) {
+			return &invite, true
+		}
+	}
+	return nil, false
+}
+
+// join lets someone with a login link choose how they'll log in, and adds them
+// to the household
+func join(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id := r.FormValue("invite")
+	invite, ok := findInvite(id)
+	if !ok {
+		flash.SetFlashes(w, []flash.Flash{{
+			Level:   flash.ERROR,
+			Message: "This login link has expired or has already been used. Please ask for a new one",
+		}})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	proxyUser, fromProxy := proxyUsername(r)
+
+	if r.Method == http.MethodPost {
+		// Otherwise another site could make the user accept its own invite
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/join?invite="+url.QueryEscape(id), http.StatusSeeOther)
+			return
+		}
+		login := User{Username: strings.TrimSpace(r.FormValue("username"))}
+		password := r.FormValue("password")
+		var user *User
+		err := ErrNoUsername
+		switch {
+		case fromProxy:
+			user, err = acceptInvite(id, User{Username: proxyUser}, "")
+		case login.Username == "":
+		case password == "":
+			err = ErrPasswordLength
+		default:
+			user, err = acceptInvite(id, login, password)
+		}
+		if err != nil {
+			flash.SetFlashes(w, []flash.Flash{{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Unable to join: %s", err),
+			}})
+			http.Redirect(w, r, "/join?invite="+url.QueryEscape(id), http.StatusSeeOther)
+			return
+		}
+		data, err := getCookie(r)
+		if err != nil {
+			log.Printf("Unable to get cookie: %s\n", err.Error())
+			data = make(map[string]string)
+		}
+		err = signIn(w, data, user)
+		if err != nil {
+			log.Printf("Failed to set cookie: %s", err)
+		}
+		flash.SetFlashes(w, []flash.Flash{{
+			Level:   flash.INFO,
+			Message: fmt.Sprintf("Welcome %s", user.Name),
+		}})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+		data = make(map[string]string)
+	}
+	renderAuthPage(w, r, "join", map[string]interface{}{
+		"Invite":        invite,
+		"ProxyUsername": proxyUser,
+		"FromProxy":     fromProxy,
+		"CSRF":          csrfToken(w, data),
+	})
+}
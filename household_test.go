@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcceptInviteExpired(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	admin := &User{ID: "admin", Name: "Admin", Role: RoleAdmin, HouseholdID: "household"}
+	invite, err := inviteUser(admin, "Sam", RoleMember)
+	if err != nil {
+		t.Fatalf("Failed to invite: %s", err)
+	}
+	invite.Expires = time.Now().Add(-time.Minute)
+	store.PutInvite(invite)
+
+	_, err = acceptInvite(invite.ID, User{Username: "sam"}, "password")
+	if !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound, got %v", err)
+	}
+	if len(householdInvites("household")) != 0 {
+		t.Errorf("Expected expired invites not to be listed")
+	}
+}
+
+func TestInviteUnknownRole(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	admin := &User{ID: "admin", Role: RoleAdmin, HouseholdID: "household"}
+	_, err := inviteUser(admin, "Sam", Role("owner"))
+	if err == nil {
+		t.Errorf("Expected an error for an unknown role")
+	}
+}
+
+func TestRemoveUser(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	admin, _ := newUser("Admin", RoleAdmin, "household")
+	member, _ := newUser("Sam", RoleMember, "household")
+	other, _ := newUser("Alex", RoleMember, "other-household")
+
+	if err := removeUser(admin, admin.ID); !errors.Is(err, ErrRemoveSelf) {
+		t.Errorf("Expected ErrRemoveSelf, got %v", err)
+	}
+	if err := removeUser(admin, other.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected users in other households not to be found, got %v", err)
+	}
+	if err := removeUser(admin, member.ID); err != nil {
+		t.Fatalf("Failed to remove user: %s", err)
+	}
+	users := householdUsers("household")
+	if len(users) != 1 || users[0].ID != admin.ID {
+		t.Errorf("Expected only the admin to be left, got %v", users)
+	}
+}
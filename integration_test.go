@@ -0,0 +1,964 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/fakesdm"
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+	"github.com/andyfoston/nest-heating-boost/nest"
+	"github.com/gorilla/securecookie"
+)
+
+// newFakeSDM points the app at a fake SDM server, returning the fake so tests
+// can set up and inspect thermostats
+func newFakeSDM(t *testing.T) *fakesdm.Server {
+	t.Helper()
+	fake := fakesdm.New("fake-project")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	oldProjectID, oldNestClient, oldDevicesCache, oldAccessTokens, oldOAuthTokenURL, oldPartnerConnectionsURL, oldCodecs, oldVault := projectID, nestClient, devicesCache, accessTokens, oauthTokenURL, partnerConnectionsURL, cookieCodecs, vault
+	t.Cleanup(func() {
+		projectID, nestClient, devicesCache, accessTokens, oauthTokenURL, partnerConnectionsURL, cookieCodecs, vault = oldProjectID, oldNestClient, oldDevicesCache, oldAccessTokens, oldOAuthTokenURL, oldPartnerConnectionsURL, oldCodecs, oldVault
+	})
+	accessTokens = newTokenManager(refreshHousehold, revokeHousehold)
+	projectID = "fake-project"
+	client := nest.NewClient(projectID, server.Client(), server.URL)
+	client.BaseBackoff, client.MaxBackoff = time.Millisecond, time.Millisecond
+	devicesCache = newDeviceCache(time.Minute)
+	nestClient = invalidatingClient{Client: client, cache: devicesCache}
+	oauthTokenURL = server.URL + "/token"
+	partnerConnectionsURL = server.URL
+	cookieCodecs = []securecookie.Codec{securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))}
+
+	var err error
+	store, err = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	vault = NewVault(store, securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)))
+	return fake
+}
+
+// authorizedCookies returns the cookies for the admin of a household which has
+// authorized access with the given refresh token
+func authorizedCookies(t *testing.T, fake *fakesdm.Server, refreshToken string) []*http.Cookie {
+	t.Helper()
+	fake.AddRefreshToken(refreshToken)
+	householdID := newID()
+	err := vault.Put(householdID, refreshToken)
+	if err != nil {
+		t.Fatalf("Failed to store refresh token: %s", err)
+	}
+	user, err := newUser("Admin", RoleAdmin, householdID)
+	if err != nil {
+		t.Fatalf("Failed to add user: %s", err)
+	}
+	return userCookies(t, user)
+}
+
+// userCookies returns the cookies for a browser signed in as the user, which
+// has loaded the home page so has a CSRF token
+func userCookies(t *testing.T, user *User) []*http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	err := setCookie(map[string]string{userKey: user.ID, csrfKey: newID()}, w)
+	if err != nil {
+		t.Fatalf("Failed to set cookie: %s", err)
+	}
+	return w.Result().Cookies()
+}
+
+// cookieUser returns the user signed in with the cookies
+func cookieUser(t *testing.T, cookies []*http.Cookie) *User {
+	t.Helper()
+	data := cookieData(t, cookies)
+	user, ok := store.User(data[userKey])
+	if !ok {
+		t.Fatalf("Expected a user to be signed in, got %v", data)
+	}
+	return user
+}
+
+// cookieData decodes the data held in the cookies
+func cookieData(t *testing.T, cookies []*http.Cookie) map[string]string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		t.Fatalf("Failed to get cookie: %s", err)
+	}
+	return data
+}
+
+// postForm posts the form with the cookies. The CSRF token in the cookies is
+// sent with the form unless the form sets one, as the forms on the home page do.
+func postForm(t *testing.T, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	if _, ok := form[csrfField]; !ok && cookies != nil {
+		if token := cookieData(t, cookies)[csrfKey]; token != "" {
+			sent := url.Values{csrfField: {token}}
+			for key, values := range form {
+				sent[key] = values
+			}
+			form = sent
+		}
+	}
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	return w
+}
+
+// updateCookies returns the cookies with those set by the response replacing
+// them, as a browser would
+func updateCookies(cookies []*http.Cookie, w *httptest.ResponseRecorder) []*http.Cookie {
+	updated := w.Result().Cookies()
+	for _, cookie := range cookies {
+		replaced := false
+		for _, set := range updated {
+			replaced = replaced || set.Name == cookie.Name
+		}
+		if !replaced {
+			updated = append(updated, cookie)
+		}
+	}
+	return updated
+}
+
+// authorizeNest authorizes access to Nest as the user signed in with the
+// cookies, returning the response from /code
+func authorizeNest(t *testing.T, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	callback, cookies := consent(t, cookies)
+	return getPage(t, callback, cookies)
+}
+
+// consent follows the link on the authorize page through the fake's consent
+// screen, returning the path Google redirects back to and the updated cookies
+func consent(t *testing.T, cookies []*http.Cookie) (string, []*http.Cookie) {
+	t.Helper()
+	w := getPage(t, "/authorize", cookies)
+	cookies = updateCookies(cookies, w)
+	match := regexp.MustCompile(`<a href="([^"]+)">Click here</a>`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("Expected a link to authorize access, got %d %s", w.Code, w.Body.String())
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatalf("Failed to authorize: %s", err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("Expected a redirect back from the consent screen, got %s", resp.Status)
+	}
+	return location.RequestURI(), cookies
+}
+
+// waitFor polls until the condition is true, as boosts are reverted in the background
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// waitForBoostsToEnd waits for the boosts to be reverted and removed from the store
+func waitForBoostsToEnd(t *testing.T) {
+	t.Helper()
+	waitFor(t, "the boosts to end", func() bool {
+		return len(store.Boosts()) == 0
+	})
+}
+
+// flashMessages returns the messages of the flashes set by a response
+func flashMessages(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	flashes, err := flash.GetFlashes(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("Failed to get flashes: %s", err)
+	}
+	messages := make([]string, 0, len(flashes))
+	for _, f := range flashes {
+		messages = append(messages, f.Message)
+	}
+	return messages
+}
+
+func heatCelsius(fake *fakesdm.Server, id string) float32 {
+	device, _ := fake.Device(id)
+	return device.HeatCelsius
+}
+
+func TestIntegrationCode(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-1", HeatCelsius: 18})
+	fake.AddAuthCode("fake-code", "refresh-token")
+	user, err := setupAdmin(User{Name: "Admin", Username: "admin"}, "password")
+	if err != nil {
+		t.Fatalf("Failed to set up admin: %s", err)
+	}
+
+	w := authorizeNest(t, userCookies(t, user))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("Expected a redirect to /, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	refreshToken, err := vault.RefreshToken(user.HouseholdID)
+	if err != nil || refreshToken != "refresh-token" {
+		t.Errorf("Expected the refresh token to be in the vault, got %q %v", refreshToken, err)
+	}
+}
+
+func TestIntegrationCodeState(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-1", HeatCelsius: 18})
+	fake.AddAuthCode("fake-code", "refresh-token")
+	user, err := setupAdmin(User{Name: "Admin", Username: "admin"}, "password")
+	if err != nil {
+		t.Fatalf("Failed to set up admin: %s", err)
+	}
+	cookies := userCookies(t, user)
+
+	w := getPage(t, "/code?code=fake-code", cookies)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback without a state to be rejected, got %d", w.Code)
+	}
+
+	// Someone else can't get the admin to store their refresh token
+	other, err := newUser("Other", RoleAdmin, newID())
+	if err != nil {
+		t.Fatalf("Failed to add user: %s", err)
+	}
+	w = getPage(t, "/authorize", userCookies(t, other))
+	state := regexp.MustCompile(`state=([^&"]+)`).FindStringSubmatch(w.Body.String())
+	if state == nil {
+		t.Fatalf("Expected the authorize link to have a state")
+	}
+	w = getPage(t, "/code?code=fake-code&state="+html.UnescapeString(state[1]), cookies)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback with someone else's state to be rejected, got %d", w.Code)
+	}
+	if vault.Has(user.HouseholdID) {
+		t.Fatalf("Expected no refresh token to be stored")
+	}
+
+	callback, cookies := consent(t, cookies)
+	w = getPage(t, callback, cookies)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", w.Code)
+	}
+	// The state can only be used once
+	fake.AddAuthCode("fake-code", "replayed-refresh-token")
+	w = getPage(t, callback, updateCookies(cookies, w))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the state not to be accepted again, got %d", w.Code)
+	}
+	refreshToken, err := vault.RefreshToken(user.HouseholdID)
+	if err != nil || refreshToken != "refresh-token" {
+		t.Errorf("Expected the first refresh token to be kept, got %q %v", refreshToken, err)
+	}
+}
+
+func TestIntegrationCodeErrors(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddAuthCode("fake-code", "refresh-token")
+	user, err := setupAdmin(User{Name: "Admin", Username: "admin"}, "password")
+	if err != nil {
+		t.Fatalf("Failed to set up admin: %s", err)
+	}
+
+	// No thermostats were selected when sharing devices
+	w := authorizeNest(t, userCookies(t, user))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No thermostats were shared") {
+		t.Errorf("Expected an explanation that no thermostats were shared, got %d", w.Code)
+	}
+
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-1", HeatCelsius: 18})
+	fake.AuthorizeError = "access_denied"
+	w = authorizeNest(t, userCookies(t, user))
+	body := w.Body.String()
+	if w.Code != http.StatusBadRequest || !strings.Contains(body, "Access to Nest wasn&#39;t allowed") {
+		t.Errorf("Expected an explanation that access was denied, got %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, `href="/authorize"`) {
+		t.Errorf("Expected a link to try again")
+	}
+	if vault.Has(user.HouseholdID) {
+		t.Errorf("Expected no refresh token to be stored")
+	}
+}
+
+func TestIntegrationCSRF(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-12", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	w := getPage(t, "/", cookies)
+	token := cookieData(t, cookies)[csrfKey]
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="csrf" value="`+token+`"`) {
+		t.Fatalf("Expected the forms to have the CSRF token, got %d", w.Code)
+	}
+
+	for _, sent := range []string{"", "forged-token"} {
+		w = postForm(t, "/boost", url.Values{"device": {"thermostat-12"}, "temperature": {"22"}, "duration": {"30"}, "csrf": {sent}}, cookies)
+		messages := flashMessages(t, w)
+		if len(messages) != 1 || !strings.Contains(messages[0], "expired") {
+			t.Errorf("Expected a boost with CSRF token %q to be rejected, got %v", sent, messages)
+		}
+		if heatCelsius(fake, "thermostat-12") != 18 {
+			t.Fatalf("Expected no boost to run with CSRF token %q", sent)
+		}
+	}
+
+	// Nor can other forms be sent from other sites
+	user := cookieUser(t, cookies)
+	postForm(t, "/account", url.Values{"username": {"attacker"}, "password": {"attackers-password"}, "csrf": {"forged-token"}}, cookies)
+	postForm(t, "/household", url.Values{"name": {"Attacker"}, "role": {"admin"}, "csrf": {"forged-token"}}, cookies)
+	if user, _ := store.User(user.ID); user.Username != "" || len(householdInvites(user.HouseholdID)) != 0 {
+		t.Errorf("Expected forms without the CSRF token to be rejected")
+	}
+	w = getPage(t, "/household/remove?id="+user.ID+"&csrf="+token, cookies)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected actions to only be posted, got %d", w.Code)
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == COOKIE_NAME && cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("Expected the cookie not to be sent with requests from other sites")
+		}
+	}
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-12"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	if heatCelsius(fake, "thermostat-12") != 22 {
+		t.Errorf("Expected the boost with the CSRF token to run, got %f", heatCelsius(fake, "thermostat-12"))
+	}
+	cancelBoost(user.HouseholdID, "thermostat-12")
+	waitForBoostsToEnd(t)
+}
+
+func TestIntegrationHouseholdsAreSeparate(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-13", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	household := cookieUser(t, cookies).HouseholdID
+	otherCookies := authorizedCookies(t, fake, "other-refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-13"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	if heatCelsius(fake, "thermostat-13") != 22 {
+		t.Fatalf("Expected the thermostat to be boosted to 22, got %f", heatCelsius(fake, "thermostat-13"))
+	}
+	recurring, err := addRecurringBoost(household, RecurringBoost{Request: BoostRequest{DeviceID: "thermostat-13", Temperature: 21, Duration: 30}, Days: weekdays, Time: "06:30"})
+	if err != nil {
+		t.Fatalf("Failed to add recurring boost: %s", err)
+	}
+	defer deleteRecurringBoost(household, recurring.ID)
+
+	// Another household can't see the boosts
+	if body := getPage(t, "/", otherCookies).Body.String(); strings.Contains(body, `name="device" value="thermostat-13"`) {
+		t.Errorf("Expected another household not to see the running boost")
+	}
+	if body := getPage(t, "/recurring", otherCookies).Body.String(); strings.Contains(body, recurring.ID) {
+		t.Errorf("Expected another household not to see the recurring boost")
+	}
+	if body := getPage(t, "/api/history", otherCookies).Body.String(); strings.TrimSpace(body) != "[]" {
+		t.Errorf("Expected another household not to see the history, got %s", body)
+	}
+	if body := getPage(t, "/api/history", cookies).Body.String(); !strings.Contains(body, "thermostat-13") {
+		t.Errorf("Expected the household to see its history, got %s", body)
+	}
+
+	// Nor change them
+	end := getActiveBoosts(household)[0].End
+	postForm(t, "/extend", url.Values{"device": {"thermostat-13"}, "minutes": {"-60"}}, otherCookies)
+	postForm(t, "/cancel", url.Values{"device": {"thermostat-13"}}, otherCookies)
+	postForm(t, "/recurring/delete", url.Values{"id": {recurring.ID}}, otherCookies)
+	boosts := getActiveBoosts(household)
+	if len(boosts) != 1 || !boosts[0].End.Equal(end) || heatCelsius(fake, "thermostat-13") != 22 {
+		t.Errorf("Expected another household not to be able to change the boost, got %v", boosts)
+	}
+	if !recurringInHousehold(household, recurring.ID) {
+		t.Errorf("Expected another household not to be able to delete the recurring boost")
+	}
+
+	cancelBoost(household, "thermostat-13")
+	waitForBoostsToEnd(t)
+}
+
+func TestIntegrationLegacyCookie(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddRefreshToken("refresh-token")
+	w := httptest.NewRecorder()
+	err := setCookie(map[string]string{authorizationCodeKey: "code", refreshTokenKey: "refresh-token"}, w)
+	if err != nil {
+		t.Fatalf("Failed to set cookie: %s", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the home page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	data := cookieData(t, w.Result().Cookies())
+	if data[refreshTokenKey] != "" || data[authorizationCodeKey] != "" {
+		t.Errorf("Expected the refresh token to be removed from the cookie, got %v", data)
+	}
+	user := cookieUser(t, w.Result().Cookies())
+	if !user.IsAdmin() {
+		t.Errorf("Expected the user to be the admin of their household")
+	}
+	refreshToken, err := vault.RefreshToken(user.HouseholdID)
+	if err != nil || refreshToken != "refresh-token" {
+		t.Errorf("Expected the refresh token to be moved into the vault, got %q %v", refreshToken, err)
+	}
+}
+
+func TestIntegrationBoostAndCancel(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-1", DisplayName: "Hallway", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-1"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	if heatCelsius(fake, "thermostat-1") != 22 {
+		t.Fatalf("Expected the thermostat to be boosted to 22, got %f", heatCelsius(fake, "thermostat-1"))
+	}
+	boosts := getActiveBoosts(cookieUser(t, cookies).HouseholdID)
+	if len(boosts) != 1 || boosts[0].Original.HeatCelsius != 18 {
+		t.Fatalf("Expected an active boost from 18, got %v", boosts)
+	}
+
+	postForm(t, "/cancel", url.Values{"device": {"thermostat-1"}}, cookies)
+	waitForBoostsToEnd(t)
+	if heatCelsius(fake, "thermostat-1") != 18 {
+		t.Errorf("Expected the thermostat to be reverted to 18, got %f", heatCelsius(fake, "thermostat-1"))
+	}
+	entry := store.History(HistoryFilter{})[0]
+	if entry.Outcome != OutcomeReverted || !entry.Cancelled {
+		t.Errorf("Expected a cancelled and reverted boost, got %v", entry)
+	}
+}
+
+func TestIntegrationResumeFinishedBoost(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-14", HeatCelsius: 22})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	householdID := cookieUser(t, cookies).HouseholdID
+	job := BoostJob{
+		ID:          newID(),
+		DeviceID:    "thermostat-14",
+		Temperature: 22,
+		Original:    nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 18},
+		Boosted:     nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 22},
+		Start:       time.Now().Add(-time.Hour),
+		End:         time.Now().Add(-time.Minute),
+		HouseholdID: householdID,
+	}
+	if err := store.PutBoost(&job); err != nil {
+		t.Fatalf("Failed to save boost: %s", err)
+	}
+
+	// A boost started before the finished one has been reverted must not
+	// capture the boosted temperature as the original
+	token, err := accessTokens.Token(householdID)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	resumeBoosts()
+	started, err := startBoost(householdID, *token, BoostRequest{DeviceID: "thermostat-14", Temperature: 21, Duration: 30, Replace: true})
+	if err != nil {
+		t.Fatalf("Failed to start boost: %s", err)
+	}
+	if started.Original.HeatCelsius != 18 {
+		t.Errorf("Expected the original temperature of 18 to be kept, got %f", started.Original.HeatCelsius)
+	}
+	cancelBoost(householdID, "thermostat-14")
+	waitForBoostsToEnd(t)
+	if heatCelsius(fake, "thermostat-14") != 18 {
+		t.Errorf("Expected the thermostat to be reverted to 18, got %f", heatCelsius(fake, "thermostat-14"))
+	}
+}
+
+func TestIntegrationRevertRetried(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-15", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	householdID := cookieUser(t, cookies).HouseholdID
+	oldRetryInterval := revertRetryInterval
+	t.Cleanup(func() { revertRetryInterval = oldRetryInterval })
+	revertRetryInterval = time.Millisecond * 10
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-15"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	fake.RateLimit(1000)
+	cancelBoost(householdID, "thermostat-15")
+	time.Sleep(time.Millisecond * 50)
+	if len(store.Boosts()) != 1 {
+		t.Fatalf("Expected the boost to be kept while Nest is unavailable")
+	}
+	fake.RateLimit(0)
+	waitForBoostsToEnd(t)
+	if heatCelsius(fake, "thermostat-15") != 18 {
+		t.Errorf("Expected the thermostat to be reverted to 18, got %f", heatCelsius(fake, "thermostat-15"))
+	}
+	entry := store.History(HistoryFilter{})[0]
+	if entry.Outcome != OutcomeReverted || !entry.Cancelled {
+		t.Errorf("Expected a cancelled and reverted boost, got %v", entry)
+	}
+}
+
+func TestIntegrationScheduledBoostWhileBoosting(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-12", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	householdID := cookieUser(t, cookies).HouseholdID
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-12"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	runScheduledBoost(ScheduledBoost{
+		ID:          newID(),
+		HouseholdID: householdID,
+		Request:     BoostRequest{DeviceID: "thermostat-12", Temperature: 24, Duration: 30},
+		StartAt:     time.Now(),
+	})
+	if heatCelsius(fake, "thermostat-12") != 22 {
+		t.Errorf("Expected the running boost to be kept, got %f", heatCelsius(fake, "thermostat-12"))
+	}
+	entries := store.History(HistoryFilter{HouseholdID: householdID})
+	if len(entries) != 2 {
+		t.Fatalf("Expected the scheduled boost to be in the history, got %v", entries)
+	}
+	failed := entries[0]
+	if failed.Outcome != OutcomeFailed || failed.RequestedTemperature != 24 || failed.Error != ErrBoostInProgress.Error() {
+		t.Errorf("Expected the scheduled boost to have failed as a boost was running, got %+v", failed)
+	}
+
+	postForm(t, "/cancel", url.Values{"device": {"thermostat-12"}}, cookies)
+	waitForBoostsToEnd(t)
+}
+
+func TestIntegrationRevertSkippedWhenChanged(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-2", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-2"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	fake.UpdateDevice("thermostat-2", func(device *fakesdm.Device) {
+		device.HeatCelsius = 20
+	})
+	// Shortening the boost past now ends it straight away
+	postForm(t, "/extend", url.Values{"device": {"thermostat-2"}, "minutes": {"-60"}}, cookies)
+	waitForBoostsToEnd(t)
+	if heatCelsius(fake, "thermostat-2") != 20 {
+		t.Errorf("Expected the temperature to be left at 20, got %f", heatCelsius(fake, "thermostat-2"))
+	}
+	if outcome := store.History(HistoryFilter{})[0].Outcome; outcome != OutcomeSkipped {
+		t.Errorf("Expected the revert to be skipped, got %s", outcome)
+	}
+}
+
+func TestIntegrationBoostCool(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-3", Mode: fakesdm.ModeCool, CoolCelsius: 25})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-3"}, "temperature": {"21"}, "duration": {"30"}}, cookies)
+	device, _ := fake.Device("thermostat-3")
+	if device.CoolCelsius != 21 {
+		t.Fatalf("Expected the thermostat to be cooling to 21, got %f", device.CoolCelsius)
+	}
+	postForm(t, "/cancel", url.Values{"device": {"thermostat-3"}}, cookies)
+	waitForBoostsToEnd(t)
+	device, _ = fake.Device("thermostat-3")
+	if device.CoolCelsius != 25 {
+		t.Errorf("Expected the thermostat to be reverted to 25, got %f", device.CoolCelsius)
+	}
+}
+
+func TestIntegrationBoostEco(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-4", EcoMode: fakesdm.EcoManual, HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-4"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	if len(fake.Commands()) != 0 || len(getActiveBoosts(cookieUser(t, cookies).HouseholdID)) != 0 {
+		t.Fatalf("Expected the boost to be refused while in eco mode")
+	}
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-4"}, "temperature": {"22"}, "duration": {"30"}, "switch": {"on"}}, cookies)
+	device, _ := fake.Device("thermostat-4")
+	if device.EcoMode != fakesdm.EcoOff || device.HeatCelsius != 22 {
+		t.Fatalf("Expected eco to be turned off and the thermostat boosted, got %v", device)
+	}
+	postForm(t, "/cancel", url.Values{"device": {"thermostat-4"}}, cookies)
+	waitForBoostsToEnd(t)
+	device, _ = fake.Device("thermostat-4")
+	if device.EcoMode != fakesdm.EcoManual {
+		t.Errorf("Expected eco mode to be restored, got %s", device.EcoMode)
+	}
+	if heatCelsius(fake, "thermostat-4") != 18 {
+		t.Errorf("Expected the heat setpoint to be restored to 18, got %f", heatCelsius(fake, "thermostat-4"))
+	}
+}
+
+func TestIntegrationHomeRateLimited(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-5", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	// More than the client will retry
+	fake.RateLimit(10)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the home page to render, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Google have blocked requests temporarily") {
+		t.Errorf("Expected a rate limit warning")
+	}
+}
+
+func TestIntegrationHomeRetriesRateLimit(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-6", DisplayName: "Landing", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	fake.RateLimit(2)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the home page to render, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "Google have blocked requests temporarily") || !strings.Contains(w.Body.String(), "Landing") {
+		t.Errorf("Expected the devices to be listed after retrying")
+	}
+}
+
+func TestIntegrationHomeUsesDeviceCache(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-7", DisplayName: "Study", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	getHome := func() string {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		newServeMux().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the home page to render, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	getHome()
+	// Any call to list devices would now be rate limited
+	fake.RateLimit(10)
+	if body := getHome(); strings.Contains(body, "Google have blocked requests temporarily") || !strings.Contains(body, "Study") {
+		t.Errorf("Expected the devices to be served from the cache")
+	}
+
+	fake.RateLimit(0)
+	fake.UpdateDevice("thermostat-7", func(device *fakesdm.Device) {
+		device.DisplayName = "Office"
+	})
+	w := postForm(t, "/refresh", url.Values{}, cookies)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", w.Code)
+	}
+	if body := getHome(); !strings.Contains(body, "Office") {
+		t.Errorf("Expected the devices to be fetched again after refreshing")
+	}
+}
+
+func TestIntegrationBoostErrors(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-8", HeatCelsius: 18, Offline: true})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	tests := []struct {
+		device   string
+		expected string
+	}{
+		{"thermostat-8", "The thermostat is offline or Google is unavailable"},
+		{"missing", "The thermostat could not be found"},
+	}
+	for _, test := range tests {
+		w := postForm(t, "/boost", url.Values{"device": {test.device}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+		messages := flashMessages(t, w)
+		if len(messages) != 1 || !strings.Contains(messages[0], test.expected) {
+			t.Errorf("Expected a flash containing %q for %s, got %v", test.expected, test.device, messages)
+		}
+	}
+
+	w := postForm(t, "/boost", url.Values{"device": {"thermostat-8"}, "temperature": {"22"}, "duration": {"30"}, "until": {"on"}, "delta": {"-1"}}, cookies)
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "can't be negative") {
+		t.Errorf("Expected a negative temperature difference to be rejected, got %v", messages)
+	}
+}
+
+func TestIntegrationHomeExpiredAccessToken(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-16", DisplayName: "Hallway", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	getPage(t, "/", cookies)
+
+	// The cached access token is rejected, but the refresh token still works
+	fake.ExpireAccessTokens()
+	devicesCache.Refresh(cookieUser(t, cookies).HouseholdID)
+	w := getPage(t, "/", cookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Hallway") {
+		t.Errorf("Expected the home page with a new access token, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIntegrationRevokedRefreshToken(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-9", HeatCelsius: 18})
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-10", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-9"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	start := time.Now().Add(time.Hour).Format("2006-01-02T15:04")
+	postForm(t, "/boost", url.Values{"device": {"thermostat-10"}, "temperature": {"22"}, "duration": {"30"}, "start": {start}}, cookies)
+	if len(getActiveBoosts(cookieUser(t, cookies).HouseholdID)) != 1 || len(store.ScheduledBoosts()) != 1 {
+		t.Fatalf("Expected a running and a scheduled boost")
+	}
+	householdID := cookieUser(t, cookies).HouseholdID
+	recurring, err := addRecurringBoost(householdID, RecurringBoost{
+		Request: BoostRequest{DeviceID: "thermostat-10", Temperature: 22, Duration: 30},
+		Days:    []time.Weekday{time.Monday},
+		Time:    "06:30",
+	})
+	if err != nil {
+		t.Fatalf("Failed to add recurring boost: %s", err)
+	}
+	defer deleteRecurringBoost(householdID, recurring.ID)
+
+	fake.RevokeRefreshToken("refresh-token")
+	// Drop the cached access token, as if it had expired
+	accessTokens.Forget(householdID)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/authorize" {
+		t.Fatalf("Expected a redirect to /authorize, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "Access to your thermostats has been removed") {
+		t.Errorf("Expected a flash explaining access was removed, got %v", messages)
+	}
+	if vault.Has(householdID) {
+		t.Errorf("Expected the refresh token to be removed from the vault")
+	}
+
+	waitForBoostsToEnd(t)
+	if len(store.ScheduledBoosts()) != 0 {
+		t.Errorf("Expected the scheduled boost to be removed")
+	}
+	if !store.RecurringBoosts()[0].Paused {
+		t.Errorf("Expected the recurring boost to be paused")
+	}
+	if heatCelsius(fake, "thermostat-9") != 22 {
+		t.Errorf("Expected the running boost to be left as is, got %f", heatCelsius(fake, "thermostat-9"))
+	}
+	entries := store.History(HistoryFilter{})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 history entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Outcome != OutcomeFailed || !strings.Contains(entry.Error, ErrInvalidGrant.Error()) {
+			t.Errorf("Expected the boosts to have failed as access was revoked, got %+v", entry)
+		}
+	}
+}
+
+func getPage(t *testing.T, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", path, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+	return w
+}
+
+func TestIntegrationHouseholdInvite(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-11", HeatCelsius: 18})
+	adminCookies := authorizedCookies(t, fake, "refresh-token")
+	admin := cookieUser(t, adminCookies)
+
+	postForm(t, "/household", url.Values{"name": {"Sam"}, "role": {"member"}}, adminCookies)
+	invites := householdInvites(admin.HouseholdID)
+	if len(invites) != 1 || invites[0].Name != "Sam" {
+		t.Fatalf("Expected an invite for Sam, got %v", invites)
+	}
+	w := getPage(t, "/household", adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/join?invite="+invites[0].ID) {
+		t.Errorf("Expected the household page to show the login link, got %d", w.Code)
+	}
+
+	w = getPage(t, "/join?invite="+invites[0].ID, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Welcome Sam") {
+		t.Fatalf("Expected the join page, got %d", w.Code)
+	}
+	joinCookies := w.Result().Cookies()
+	// Another site can't make someone accept an invite it was sent
+	postForm(t, "/join", url.Values{"invite": {invites[0].ID}, "username": {"attacker"}, "password": {"attackers-password"}}, nil)
+	if _, ok := userByUsername("attacker"); ok {
+		t.Errorf("Expected joining without the CSRF token to be rejected")
+	}
+	w = postForm(t, "/join", url.Values{"invite": {invites[0].ID}, "username": {"sam"}, "password": {"sams-password"}}, joinCookies)
+	memberCookies := w.Result().Cookies()
+	member := cookieUser(t, memberCookies)
+	memberCookies = updateCookies(memberCookies, getPage(t, "/", memberCookies))
+	if member.Name != "Sam" || member.IsAdmin() || member.HouseholdID != admin.HouseholdID {
+		t.Fatalf("Expected Sam to join the household as a member, got %+v", member)
+	}
+	w = postForm(t, "/join", url.Values{"invite": {invites[0].ID}, "username": {"sam2"}, "password": {"sams-password"}}, joinCookies)
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "already been used") {
+		t.Errorf("Expected the login link to only work once, got %v", messages)
+	}
+
+	// Members boost with the household's access to Nest
+	postForm(t, "/boost", url.Values{"device": {"thermostat-11"}, "temperature": {"22"}, "duration": {"30"}}, memberCookies)
+	if heatCelsius(fake, "thermostat-11") != 22 {
+		t.Errorf("Expected the member's boost to run, got %f", heatCelsius(fake, "thermostat-11"))
+	}
+	cancelBoost(admin.HouseholdID, "thermostat-11")
+	waitForBoostsToEnd(t)
+	entries := store.History(HistoryFilter{})
+	if len(entries) != 1 || entries[0].RequestedBy != "Sam" {
+		t.Errorf("Expected the boost to be recorded as requested by Sam, got %v", entries)
+	}
+
+	// but can't manage the household or authorize access
+	w = getPage(t, "/household", memberCookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("Expected members to be redirected from the household page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w = getPage(t, "/authorize", memberCookies)
+	if strings.Contains(w.Body.String(), "Click here") {
+		t.Errorf("Expected members not to be offered to authorize access")
+	}
+	fake.AddAuthCode("auth-code", "member-refresh-token")
+	w = getPage(t, "/code?code=auth-code", memberCookies)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected members to be forbidden from authorizing access, got %d", w.Code)
+	}
+
+	postForm(t, "/household/remove", url.Values{"id": {member.ID}}, adminCookies)
+	w = getPage(t, "/", memberCookies)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("Expected a removed member to be signed out, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIntegrationHouseholdReauthorize(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-1", HeatCelsius: 18})
+	adminCookies := authorizedCookies(t, fake, "refresh-token")
+	admin := cookieUser(t, adminCookies)
+	member, err := newUser("Sam", RoleMember, admin.HouseholdID)
+	if err != nil {
+		t.Fatalf("Failed to add member: %s", err)
+	}
+	fake.RevokeRefreshToken("refresh-token")
+	revokeHousehold(admin.HouseholdID)
+
+	fake.AddAuthCode("fake-code", "new-refresh-token")
+	w := authorizeNest(t, adminCookies)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", w.Code)
+	}
+	refreshToken, err := vault.RefreshToken(admin.HouseholdID)
+	if err != nil || refreshToken != "new-refresh-token" {
+		t.Errorf("Expected the household's refresh token to be replaced, got %q %v", refreshToken, err)
+	}
+	w = getPage(t, "/", userCookies(t, member))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the member to be able to boost again, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIntegrationRevokedByRevert(t *testing.T) {
+	fake := newFakeSDM(t)
+	fake.AddDevice(fakesdm.Device{ID: "thermostat-11", HeatCelsius: 18})
+	cookies := authorizedCookies(t, fake, "refresh-token")
+	householdID := cookieUser(t, cookies).HouseholdID
+
+	postForm(t, "/boost", url.Values{"device": {"thermostat-11"}, "temperature": {"22"}, "duration": {"30"}}, cookies)
+	fake.RevokeRefreshToken("refresh-token")
+	accessTokens.Forget(householdID)
+	// End the boost now, so the revert is the first to find access was revoked
+	postForm(t, "/extend", url.Values{"device": {"thermostat-11"}, "minutes": {"-60"}}, cookies)
+	waitFor(t, "the refresh token to be removed", func() bool { return !vault.Has(householdID) })
+	waitForBoostsToEnd(t)
+
+	w := getPage(t, "/", cookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/authorize" {
+		t.Fatalf("Expected a redirect to /authorize, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	messages := flashMessages(t, w)
+	if len(messages) != 1 || !strings.Contains(messages[0], "Access to your thermostats has been removed") {
+		t.Errorf("Expected a flash explaining access was removed, got %v", messages)
+	}
+
+	// Households which were never authorized aren't told access was removed
+	other, err := newUser("Other", RoleAdmin, newID())
+	if err != nil {
+		t.Fatalf("Failed to create user: %s", err)
+	}
+	w = getPage(t, "/", userCookies(t, other))
+	if messages := flashMessages(t, w); len(messages) != 0 {
+		t.Errorf("Expected no flash for a household which was never authorized, got %v", messages)
+	}
+
+	// Authorizing again clears the marker
+	vault.Put(householdID, "new-refresh-token")
+	if vault.Revoked(householdID) {
+		t.Errorf("Expected a new refresh token to clear the revoked marker")
+	}
+}
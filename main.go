@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -9,8 +10,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	// Embedded as the image has no zoneinfo. Times in the forms are read in
+	// the time zone set by TZ, such as Europe/London.
+	_ "time/tzdata"
 
 	flash "github.com/andyfoston/nest-heating-boost/flash"
+	"github.com/andyfoston/nest-heating-boost/nest"
 	"github.com/gorilla/securecookie"
 )
 
@@ -20,17 +25,130 @@ var (
 	clientSecret = os.Getenv("CLIENT_SECRET")
 	hashKey      = os.Getenv("HASH_KEY")
 	blockKey     = os.Getenv("BLOCK_KEY")
-	s            = securecookie.New([]byte(hashKey), []byte(blockKey))
-	httpsCookie  = strings.ToLower(os.Getenv("INSECURE_COOKIE")) != "true"
+	// The previous keys are still accepted while rotating HASH_KEY and
+	// BLOCK_KEY, so that cookies and the vault can be moved to the new keys
+	previousHashKey  = os.Getenv("PREVIOUS_HASH_KEY")
+	previousBlockKey = os.Getenv("PREVIOUS_BLOCK_KEY")
+	cookieCodecs     = securecookie.CodecsFromPairs(keyPairs()...)
+	httpsCookie      = strings.ToLower(os.Getenv("INSECURE_COOKIE")) != "true"
+	storePath        = getEnv("STORE_PATH", "data/store.json")
+	// The Google endpoints can be overridden to point at a fake, such as the
+	// one in the fakesdm package
+	sdmBaseURL            = getEnv("SDM_BASE_URL", nest.DefaultBaseURL)
+	oauthTokenURL         = getEnv("OAUTH_TOKEN_URL", "https://www.googleapis.com/oauth2/v4/token")
+	partnerConnectionsURL = getEnv("PARTNER_CONNECTIONS_URL", "https://nestservices.google.com")
+	store                 *Store
+	vault                 *Vault
+	// Logging in with an OpenID Connect provider is enabled by setting
+	// OIDC_ISSUER. The first person to log in with it sets up the app.
+	oidcIssuer       = os.Getenv("OIDC_ISSUER")
+	oidcClientID     = os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	oidcRedirectURL  = os.Getenv("OIDC_REDIRECT_URL")
+	// A reverse proxy which logs users in can pass their username in the
+	// AUTH_PROXY_HEADER header. It's only trusted from TRUSTED_PROXIES, a
+	// comma separated list of addresses or networks.
+	proxyAuthHeader = os.Getenv("AUTH_PROXY_HEADER")
+	trustedProxies  = parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	// Requests to the SDM API are limited to stay under the quota for the
+	// project, which is shared by every user of the app
+	sdmRequestsPerMinute = getEnvInt("SDM_REQUESTS_PER_MINUTE", 60)
+	sdmRequestBurst      = getEnvInt("SDM_REQUEST_BURST", 10)
+	accessTokens         = newTokenManager(refreshHousehold, revokeHousehold)
+	// Device lists are cached, and refreshed after a command changes a device
+	devicesCache             = newDeviceCache(getEnvDuration("DEVICE_CACHE_TTL", 5*time.Minute))
+	nestClient   nest.Client = invalidatingClient{Client: newNestClient(), cache: devicesCache}
 )
 
 const (
-	COOKIE_NAME      = "nest-boost"
-	THERMOSTAT_CACHE = "thermostat-cache"
+	COOKIE_NAME = "nest-boost"
 )
 
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// keyPairs returns the hash and block keys for securecookie, current first
+func keyPairs() [][]byte {
+	pairs := [][]byte{[]byte(hashKey), []byte(blockKey)}
+	if previousHashKey != "" {
+		var previousBlock []byte
+		if previousBlockKey != "" {
+			previousBlock = []byte(previousBlockKey)
+		}
+		pairs = append(pairs, []byte(previousHashKey), previousBlock)
+	}
+	return pairs
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %d", value, key, fallback)
+		return fallback
+	}
+	return i
+}
+
+// rateLimitMessage tells the user how long to wait after being rate limited,
+// if Google said
+func rateLimitMessage(err error) string {
+	var rateLimit *nest.RateLimitError
+	if errors.As(err, &rateLimit) && rateLimit.RetryAfter > 0 {
+		return fmt.Sprintf("Google have blocked requests temporarily. Please try again in %s.", rateLimit.RetryAfter.Round(time.Second))
+	}
+	return "Google have blocked requests temporarily. Please try again in a couple of minutes."
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// sdmErrorMessage explains an error from the SDM API to the user, with what
+// they can do about it. It returns false for errors it doesn't recognise.
+func sdmErrorMessage(err error) (string, bool) {
+	var apiError *nest.APIError
+	switch {
+	case errors.Is(err, nest.ErrRateLimit):
+		return rateLimitMessage(err), true
+	case errors.Is(err, nest.ErrUnauthenticated):
+		return "Your access to Nest has expired. Please authorize access to Nest again", true
+	case errors.Is(err, nest.ErrPermissionDenied):
+		return "Access to your thermostats has been removed in your Google account. Please authorize access to Nest again", true
+	case errors.Is(err, nest.ErrNotFound):
+		return "The thermostat could not be found. It may have been removed from your Google account", true
+	case errors.Is(err, nest.ErrUnavailable):
+		return "The thermostat is offline or Google is unavailable. Please try again in a few minutes", true
+	case errors.Is(err, nest.ErrFailedPrecondition) && errors.As(err, &apiError):
+		return fmt.Sprintf("The thermostat can't do that in its current mode: %s", apiError.Message), true
+	}
+	return "", false
+}
+
+func newNestClient() *nest.SDMClient {
+	client := nest.NewClient(projectID, nil, sdmBaseURL)
+	client.Limiter = nest.NewRateLimiter(sdmRequestsPerMinute, sdmRequestBurst)
+	return client
+}
+
 func _setCookie(value map[string]string, w http.ResponseWriter, cookieName string, expires time.Time) error {
-	encoded, err := s.Encode(cookieName, value)
+	encoded, err := securecookie.EncodeMulti(cookieName, value, cookieCodecs...)
 	if err == nil {
 		cookie := &http.Cookie{
 			Name:     cookieName,
@@ -38,6 +156,7 @@ func _setCookie(value map[string]string, w http.ResponseWriter, cookieName strin
 			Path:     "/",
 			Secure:   httpsCookie,
 			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
 			Expires:  expires,
 		}
 		http.SetCookie(w, cookie)
@@ -49,10 +168,6 @@ func setCookie(value map[string]string, w http.ResponseWriter) error {
 	return _setCookie(value, w, COOKIE_NAME, time.Now().Add(time.Hour*24*365))
 }
 
-func setCacheCookie(value map[string]string, w http.ResponseWriter) error {
-	return _setCookie(value, w, "_cache", time.Now().Add(time.Second*600))
-}
-
 func _getCookie(r *http.Request, cookieName string) (map[string]string, error) {
 	cookie, err := r.Cookie(cookieName)
 	value := make(map[string]string)
@@ -64,7 +179,7 @@ func _getCookie(r *http.Request, cookieName string) (map[string]string, error) {
 			return nil, err
 		}
 	}
-	err = s.Decode(cookieName, cookie.Value, &value)
+	err = securecookie.DecodeMulti(cookieName, cookie.Value, &value, cookieCodecs...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,10 +190,6 @@ func getCookie(r *http.Request) (map[string]string, error) {
 	return _getCookie(r, COOKIE_NAME)
 }
 
-func getCacheCookie(r *http.Request) (map[string]string, error) {
-	return _getCookie(r, "_cache")
-}
-
 // Get temperature from device
 
 func homePage(w http.ResponseWriter, r *http.Request) {
@@ -86,8 +197,14 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Unable to get cookie: %s\n", err.Error())
 	}
-	if !hasAuthorizationCode(data) {
-		log.Println("No authorization code found. Redirecting to /authorize")
+	user, _ := userFromCookie(w, data)
+	householdID, ok := authorizedHouseholdFromCookie(w, data)
+	if !ok {
+		log.Println("Household has no access to Nest. Redirecting to /authorize")
+		if vault.Revoked(householdID) {
+			// A background job found access had been revoked
+			flash.SetFlashes(w, []flash.Flash{tokenErrorFlash(ErrInvalidGrant)})
+		}
 		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
 		return
 	}
@@ -105,32 +222,53 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 
 	// FIXME handle errors
 	flashes := make([]flash.Flash, 0)
-	refreshToken := data[refreshTokenKey]
-	token, err := GetTokenFromRefreshToken(refreshToken)
+	token, err := accessTokens.Token(householdID)
 	if err != nil {
-		log.Printf("Failed to get token from refresh token: %s\n", err)
+		log.Printf("Failed to get token for household: %s\n", err)
+		flash.SetFlashes(w, []flash.Flash{tokenErrorFlash(err)})
 		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
 		return
 	}
 	enableSubmit := true
-	devices, err := GetDevices(token.AccessToken)
+	devices, updated, err := devicesCache.Devices(householdID, *token)
+	if errors.Is(err, nest.ErrUnauthenticated) {
+		// The cached access token has usually gone stale, while the refresh
+		// token is still fine, so try once more with a new access token
+		log.Printf("Access token was rejected listing devices. Trying again with a new one")
+		accessTokens.Forget(householdID)
+		token, err = accessTokens.Token(householdID)
+		if err == nil {
+			devices, updated, err = devicesCache.Devices(householdID, *token)
+		}
+	}
 	if err != nil {
-		switch err {
-		case ErrRateLimit:
+		log.Printf("Unable to get a list of devices: %s\n", err)
+		switch {
+		case errors.Is(err, ErrInvalidGrant):
+			flash.SetFlashes(w, []flash.Flash{tokenErrorFlash(err)})
+			http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+			return
+		case errors.Is(err, nest.ErrPermissionDenied):
+			accessTokens.Forget(householdID)
+			message, _ := sdmErrorMessage(err)
 			flashes = append(flashes, flash.Flash{
 				Level:   flash.WARN,
-				Message: "Google have blocked requests temporarily. Please try again in a couple of minutes.",
+				Message: message,
 			})
-			enableSubmit = false
+			flash.SetFlashes(w, flashes)
+			http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+			return
 		default:
-			log.Println("Unable to get a list of devices. Token: ", token.AccessToken, "Error:", err)
+			message, ok := sdmErrorMessage(err)
+			if !ok {
+				message = "Unable to get a list of thermostats. Please try again in a couple of minutes."
+			}
 			flashes = append(flashes, flash.Flash{
 				Level:   flash.WARN,
-				Message: "Unable to get a list of devices. Please try authorization access to Nest again",
+				Message: message,
 			})
-			flash.SetFlashes(w, flashes)
-			http.Redirect(w, r, "/authorize", http.StatusSeeOther)
-			return
+			devices = &nest.Devices{}
+			enableSubmit = false
 		}
 	} else {
 		f, err := flash.GetFlashes(w, r)
@@ -140,7 +278,23 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 			flashes = f
 		}
 	}
-	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{"Flashes": flashes, "Devices": devices.Devices, "enableSubmit": enableSubmit})
+	for _, device := range devices.Devices {
+		if !device.IsThermostat() {
+			continue
+		}
+		if device.Traits.EcoEnabled() {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: fmt.Sprintf("%s is in eco mode. Tick \"Turn the heating on\" to turn eco mode off while boosting", device.DisplayName()),
+			})
+		} else if device.Traits.ThermostatMode.Mode == nest.ThermostatModeOff {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: fmt.Sprintf("%s is turned off. Tick \"Turn the heating on\" to turn it on while boosting", device.DisplayName()),
+			})
+		}
+	}
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{"Flashes": flashes, "Devices": devices.Devices, "enableSubmit": enableSubmit, "Boosts": getBoostViews(householdID, devices.Devices), "Scheduled": getScheduledBoostViews(householdID, devices.Devices), "Updated": updated, "User": user, "CSRF": csrfToken(w, data)})
 	if err != nil {
 		log.Printf("Failed to execute template: %s\n", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -148,46 +302,42 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func runBoost(token Token, deviceId string, desiredTemp float32, duration int) {
-	originalTemperature, err := GetTemperature(token.AccessToken, deviceId)
+func main() {
+	var err error
+	store, err = OpenStore(storePath)
 	if err != nil {
-		log.Printf("Failed to get initial temperature: %s", err)
-		return
+		log.Fatalf("Failed to open store %s: %s", storePath, err)
 	}
-
-	err = SetTemperature(token.AccessToken, deviceId, desiredTemp)
-	if err != nil {
-		log.Printf("Failed to set temperature: %s", err)
-		return
+	if blockKey == "" {
+		log.Fatalf("BLOCK_KEY must be set to encrypt refresh tokens")
 	}
-	time.Sleep(time.Minute * time.Duration(duration))
-	newToken, err := GetTokenFromRefreshToken(token.RefreshToken)
+	vault = NewVault(store, securecookie.CodecsFromPairs(keyPairs()...)...)
+	err = vault.Rotate()
 	if err != nil {
-		log.Printf("Failed to get a new access token: %s", err)
-		return
+		log.Fatalf("Failed to rotate the vault keys: %s", err)
 	}
-	token = *newToken
-	log.Printf("Token: %v", token)
-	newTemperature, err := GetTemperature(token.AccessToken, deviceId)
-	if err != nil {
-		log.Println("Failed to get temperature before resetting to normal:", err)
-		return
-	}
-	if *newTemperature+0.3 < desiredTemp || *newTemperature-0.3 > desiredTemp {
-		log.Printf("Temperature has changed since boosting. Leaving as is: Current: %f, expected: %f", *newTemperature, desiredTemp)
-		return
-	}
-	SetTemperature(token.AccessToken, deviceId, *originalTemperature)
+	resumeBoosts()
+	resumeScheduledBoosts()
+	resumeRecurringBoosts()
 
+	if proxyAuthHeader != "" && len(trustedProxies) == 0 {
+		log.Printf("AUTH_PROXY_HEADER is set without TRUSTED_PROXIES, so it will be ignored")
+	}
+	http.ListenAndServe(":8080", newServeMux())
 }
 
-func main() {
+// newServeMux returns the handlers for the app, which need a login other than
+// for the publicPaths
+func newServeMux() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/boost", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		// Setting the redirect before cookies appears to cause cookies not to be set
 		defer http.Redirect(w, r, "/", http.StatusSeeOther)
+		if !checkCSRF(w, r) {
+			return
+		}
 		deviceId := r.FormValue("device")
 		temperature, tempErr := strconv.ParseFloat(r.FormValue("temperature"), 32)
 		duration, durationErr := strconv.ParseInt(r.FormValue("duration"), 10, 16)
@@ -210,7 +360,33 @@ func main() {
 				Message: fmt.Sprintf("Unable to get the duration to run the heating for: %s", tempErr),
 			})
 		}
-		if deviceId == "" || tempErr != nil || durationErr != nil {
+		var delta float64
+		var deltaErr error
+		if value := r.FormValue("delta"); value != "" {
+			delta, deltaErr = strconv.ParseFloat(value, 32)
+			if deltaErr == nil && delta < 0 {
+				// The boost would run past the temperature asked for
+				deltaErr = errors.New("it can't be negative")
+			}
+			if deltaErr != nil {
+				flashes = append(flashes, flash.Flash{
+					Level:   flash.ERROR,
+					Message: fmt.Sprintf("Unable to get the temperature difference to stop at: %s", deltaErr),
+				})
+			}
+		}
+		var startAt time.Time
+		var startErr error
+		if start := r.FormValue("start"); start != "" {
+			startAt, startErr = time.ParseInLocation("2006-01-02T15:04", start, time.Local)
+			if startErr != nil {
+				flashes = append(flashes, flash.Flash{
+					Level:   flash.ERROR,
+					Message: fmt.Sprintf("Unable to get the time to start the heating at: %s", startErr),
+				})
+			}
+		}
+		if deviceId == "" || tempErr != nil || durationErr != nil || deltaErr != nil || startErr != nil {
 			flash.SetFlashes(w, flashes)
 			return
 		}
@@ -220,37 +396,203 @@ func main() {
 		if err != nil {
 			log.Println("Failed to get cookie. Error", err.Error())
 		}
-		refreshToken := data[refreshTokenKey]
-		log.Printf("refreshToken: %s\n", refreshToken)
-		token, err := GetTokenFromRefreshToken(refreshToken)
+		user, _ := userFromCookie(w, data)
+		householdID, _ := authorizedHouseholdFromCookie(w, data)
+		token, err := accessTokens.Token(householdID)
 		if err != nil {
 			log.Printf("Failed: %s\n", err)
+			flashes = append(flashes, tokenErrorFlash(err))
+			flash.SetFlashes(w, flashes)
+			return
+		}
+		request := BoostRequest{
+			DeviceID:     deviceId,
+			Temperature:  float32(temperature),
+			Duration:     int(duration),
+			Replace:      r.FormValue("replace") == "on",
+			RequestedBy:  requestedBy(r, user),
+			UntilReached: r.FormValue("until") == "on",
+			Delta:        float32(delta),
+			SwitchMode:   r.FormValue("switch") == "on",
+		}
+		if startAt.After(time.Now()) {
+			scheduled, err := scheduleBoost(householdID, request, startAt)
+			if err != nil {
+				log.Printf("Failed to schedule boost: %s\n", err)
+				flashes = append(flashes, flash.Flash{
+					Level:   flash.ERROR,
+					Message: fmt.Sprintf("Failed to schedule boost: %s", err),
+				})
+			} else {
+				flashes = append(flashes, flash.Flash{
+					Level:   flash.INFO,
+					Message: fmt.Sprintf("Scheduled temperature to be set to %s°C at %s for %d minute(s)", r.FormValue("temperature"), scheduled.StartAt.Format("Mon 15:04"), duration),
+				})
+			}
+			flash.SetFlashes(w, flashes)
+			return
+		}
+		job, err := startBoost(householdID, *token, request)
+		switch {
+		case errors.Is(err, ErrBoostInProgress) && job == nil:
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: "Another household is already boosting this thermostat",
+			})
+		case errors.Is(err, ErrBoostInProgress):
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: fmt.Sprintf("A boost to %.1f°C is already running on this thermostat until %s. Tick \"Replace running boost\" to replace it", job.Temperature, job.End.Format("15:04")),
+			})
+		case errors.Is(err, nest.ErrEcoEnabled), errors.Is(err, nest.ErrThermostatOff):
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: "The thermostat is turned off or in eco mode, so it can't be boosted. Tick \"Turn the heating on\" to switch it on for the boost",
+			})
+		case err != nil:
+			log.Printf("Failed to run boost: %s\n", err)
+			message := fmt.Sprintf("Failed to run boost: %s", err)
+			if sdmMessage, ok := sdmErrorMessage(err); ok {
+				message = fmt.Sprintf("Failed to run boost. %s", sdmMessage)
+			}
 			flashes = append(flashes, flash.Flash{
 				Level:   flash.ERROR,
-				Message: fmt.Sprintf("Failed to run boost: %s", err),
+				Message: message,
+			})
+		case job.UntilReached:
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: fmt.Sprintf("Setting temperature to %s°C until the room reaches it, for at most %d minute(s)", r.FormValue("temperature"), duration),
+			})
+		default:
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: fmt.Sprintf("Setting temperature to %s°C for %d minute(s)", r.FormValue("temperature"), duration),
+			})
+		}
+		err = flash.SetFlashes(w, flashes)
+		if err != nil {
+			log.Printf("Failed to set flash: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		defer http.Redirect(w, r, "/", http.StatusSeeOther)
+		if !checkCSRF(w, r) {
+			return
+		}
+		householdID, ok := householdFromRequest(w, r)
+		if !ok {
+			return
+		}
+		flashes := make([]flash.Flash, 0, 1)
+		job, err := cancelBoost(householdID, r.FormValue("device"))
+		if err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: "There is no boost running on this thermostat",
+			})
+		} else {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: fmt.Sprintf("Boost cancelled. Restoring temperature to %s", job.Original),
+			})
+		}
+		err = flash.SetFlashes(w, flashes)
+		if err != nil {
+			log.Printf("Failed to set flash: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/extend", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		defer http.Redirect(w, r, "/", http.StatusSeeOther)
+		if !checkCSRF(w, r) {
+			return
+		}
+		householdID, ok := householdFromRequest(w, r)
+		if !ok {
+			return
+		}
+		flashes := make([]flash.Flash, 0, 1)
+		minutes, err := strconv.ParseInt(r.FormValue("minutes"), 10, 16)
+		if err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Unable to get the number of minutes to change the boost by: %s", err),
 			})
 			flash.SetFlashes(w, flashes)
 			return
 		}
-		log.Printf("Token: %v\n", token)
-		go runBoost(*token, deviceId, float32(temperature), int(duration))
-		flashes = append(flashes, flash.Flash{
-			Level:   flash.INFO,
-			Message: fmt.Sprintf("Setting temperature to %s°C for %d minute(s)", r.FormValue("temperature"), duration),
-		})
+		job, err := changeBoostEnd(householdID, r.FormValue("device"), time.Minute*time.Duration(minutes))
+		if err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: "There is no boost running on this thermostat",
+			})
+		} else {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: fmt.Sprintf("Boost will now end at %s", job.End.Format("15:04")),
+			})
+		}
+		err = flash.SetFlashes(w, flashes)
+		if err != nil {
+			log.Printf("Failed to set flash: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/schedule/cancel", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		defer http.Redirect(w, r, "/", http.StatusSeeOther)
+		if !checkCSRF(w, r) {
+			return
+		}
+		householdID, ok := householdFromRequest(w, r)
+		if !ok {
+			return
+		}
+		flashes := make([]flash.Flash, 0, 1)
+		_, err := cancelScheduledBoost(householdID, r.FormValue("id"))
+		if err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.WARN,
+				Message: "The scheduled boost has already started or been cancelled",
+			})
+		} else {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: "Scheduled boost cancelled",
+			})
+		}
 		err = flash.SetFlashes(w, flashes)
 		if err != nil {
 			log.Printf("Failed to set flash: %s\n", err)
 		}
 	})
+	mux.HandleFunc("/recurring", recurringPage)
+	mux.HandleFunc("/recurring/delete", recurringAction)
+	mux.HandleFunc("/recurring/pause", recurringAction)
+	mux.HandleFunc("/recurring/skip", recurringAction)
+	mux.HandleFunc("/refresh", refreshDevices)
+	mux.HandleFunc("/history", historyPage)
+	mux.HandleFunc("/api/history", historyJSON)
 	mux.HandleFunc("/", homePage)
 	mux.HandleFunc("/authorize", AuthorizeAccess)
 	mux.HandleFunc("/code", code)
+	mux.HandleFunc("/household", householdPage)
+	mux.HandleFunc("/household/remove", householdAction)
+	mux.HandleFunc("/household/uninvite", householdAction)
+	mux.HandleFunc("/join", join)
+	mux.HandleFunc("/login", loginPage)
+	mux.HandleFunc("/login/oidc", oidcLogin)
+	mux.HandleFunc("/login/oidc/callback", oidcCallback)
+	mux.HandleFunc("/logout", logout)
+	mux.HandleFunc("/setup", setupPage)
+	mux.HandleFunc("/account", accountPage)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	http.ListenAndServe(":8080", mux)
+	return requireLogin(mux)
 }
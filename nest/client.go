@@ -0,0 +1,204 @@
+package nest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultBaseURL is the address of the Google Smart Device Management API
+const DefaultBaseURL = "https://smartdevicemanagement.googleapis.com"
+
+// Client makes calls to the Smart Device Management API. Access tokens are
+// passed to each call, as each user of the app has their own.
+type Client interface {
+	ListDevices(accessToken string) (*Devices, error)
+	GetDevice(accessToken, deviceID string) (*Device, error)
+	ExecuteCommand(accessToken, deviceID string, command ExecuteCommandRequest) error
+}
+
+// SDMClient is a Client which calls the API over HTTP. Failed calls are
+// retried with jittered exponential backoff: reads are retried after rate
+// limiting, server errors and network errors, but commands are only retried
+// after rate limiting, as otherwise they may already have been applied.
+type SDMClient struct {
+	httpClient *http.Client
+	projectID  string
+	baseURL    string
+
+	// Limiter, if set, is waited on before every request to stay under the
+	// quota for the project
+	Limiter *RateLimiter
+	// MaxRetries is the number of times a failed call is retried
+	MaxRetries int
+	// BaseBackoff is the wait before the first retry, doubling for each one
+	// after up to MaxBackoff. A Retry-After longer than MaxBackoff isn't
+	// waited for, and the rate limit error is returned straight away.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	sleep func(time.Duration)
+}
+
+// NewClient returns a client for the devices in a Device Access project. If
+// httpClient is nil, http.DefaultClient is used and if baseURL is empty,
+// DefaultBaseURL is used.
+func NewClient(projectID string, httpClient *http.Client, baseURL string) *SDMClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &SDMClient{
+		httpClient:  httpClient,
+		projectID:   projectID,
+		baseURL:     baseURL,
+		MaxRetries:  3,
+		BaseBackoff: time.Second,
+		MaxBackoff:  10 * time.Second,
+		sleep:       time.Sleep,
+	}
+}
+
+func (c *SDMClient) devicesURL() string {
+	return fmt.Sprintf("%s/v1/enterprises/%s/devices", c.baseURL, c.projectID)
+}
+
+// backoff returns how long to wait before the given retry, with jitter so
+// that clients rate limited at the same time don't all retry together
+func (c *SDMClient) backoff(retry int) time.Duration {
+	backoff := c.BaseBackoff << retry
+	if backoff > c.MaxBackoff || backoff <= 0 {
+		backoff = c.MaxBackoff
+	}
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+func (c *SDMClient) makeApiCall(url string, method string, accessToken string, requestData []byte, responseObject interface{}) error {
+	idempotent := method == http.MethodGet
+	for retry := 0; ; retry++ {
+		err := c.doApiCall(url, method, accessToken, requestData, responseObject)
+		if err == nil || retry >= c.MaxRetries {
+			return err
+		}
+		wait := c.backoff(retry)
+		var rateLimit *RateLimitError
+		switch {
+		case errors.As(err, &rateLimit):
+			if rateLimit.RetryAfter > c.MaxBackoff {
+				return err
+			}
+			if rateLimit.RetryAfter > 0 {
+				wait = rateLimit.RetryAfter
+			}
+		case errors.Is(err, ErrUnavailable):
+			if !idempotent {
+				return err
+			}
+		default:
+			return err
+		}
+		log.Printf("%s %s failed: %s. Retrying in %s", method, url, err, wait)
+		c.sleep(wait)
+	}
+}
+
+// doApiCall makes a single attempt at a call. Rate limiting is returned as a
+// *RateLimitError, error responses as an *APIError and network errors as an
+// *unavailableError.
+func (c *SDMClient) doApiCall(url string, method string, accessToken string, requestData []byte, responseObject interface{}) error {
+	if c.Limiter != nil {
+		c.Limiter.Wait()
+	}
+	var body io.Reader
+	if requestData != nil {
+		body = bytes.NewReader(requestData)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseAPIError(resp.StatusCode, respBody)
+	}
+	err = json.Unmarshal(respBody, &responseObject)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of
+// seconds or a date. Zero is returned if it is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func (c *SDMClient) ListDevices(accessToken string) (*Devices, error) {
+	response := Devices{}
+	err := c.makeApiCall(c.devicesURL(), http.MethodGet, accessToken, nil, &response)
+	if err != nil {
+		if errors.Is(err, ErrRateLimit) {
+			// `response` will be an empty Devices instance
+			return &response, err
+		}
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (c *SDMClient) GetDevice(accessToken string, deviceID string) (*Device, error) {
+	url := fmt.Sprintf("%s/%s", c.devicesURL(), deviceID)
+	device := Device{}
+	err := c.makeApiCall(url, http.MethodGet, accessToken, nil, &device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (c *SDMClient) ExecuteCommand(accessToken, deviceID string, command ExecuteCommandRequest) error {
+	url := fmt.Sprintf("%s/%s:executeCommand", c.devicesURL(), deviceID)
+	request, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return c.makeApiCall(url, http.MethodPost, accessToken, request, "")
+}
@@ -0,0 +1,202 @@
+package nest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClientGetDevice(t *testing.T) {
+	body, err := os.ReadFile("testdata/device_heatcool.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/enterprises/project/devices/device-1" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected Authorization header %s", r.Header.Get("Authorization"))
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := NewClient("project", server.Client(), server.URL)
+	device, err := client.GetDevice("token", "device-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if device.Traits.ThermostatMode.Mode != ThermostatModeHeatCool {
+		t.Errorf("Expected HEATCOOL, got %s", device.Traits.ThermostatMode.Mode)
+	}
+}
+
+func TestClientExecuteCommand(t *testing.T) {
+	var received ExecuteCommandRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/enterprises/project/devices/device-1:executeCommand" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client := NewClient("project", server.Client(), server.URL)
+	err := SetSetpoint(client, "token", "device-1", Setpoint{Mode: ThermostatModeHeat, HeatCelsius: 21})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if received.Command != "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat" || received.Params["heatCelsius"] != 21.0 {
+		t.Errorf("Unexpected command %+v", received)
+	}
+}
+
+// newTestClient returns a client for the server which records how long it
+// would have slept between retries instead of sleeping
+func newTestClient(server *httptest.Server) (*SDMClient, *[]time.Duration) {
+	client := NewClient("project", server.Client(), server.URL)
+	sleeps := make([]time.Duration, 0)
+	client.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return client, &sleeps
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, sleeps := newTestClient(server)
+	devices, err := client.ListDevices("token")
+	if !errors.Is(err, ErrRateLimit) {
+		t.Fatalf("Expected ErrRateLimit, got %v", err)
+	}
+	if devices == nil || len(devices.Devices) != 0 {
+		t.Errorf("Expected an empty list of devices")
+	}
+	if len(*sleeps) != client.MaxRetries {
+		t.Errorf("Expected %d retries, got %d", client.MaxRetries, len(*sleeps))
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, sleeps := newTestClient(server)
+	err := client.ExecuteCommand("token", "device-1", GetSetHeatCommandRequest(21))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != 2*time.Second {
+		t.Errorf("Expected to wait 2s as asked by Retry-After, got %v", *sleeps)
+	}
+}
+
+func TestClientRetryAfterTooLong(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, sleeps := newTestClient(server)
+	_, err := client.GetDevice("token", "device-1")
+	var rateLimit *RateLimitError
+	if !errors.As(err, &rateLimit) || rateLimit.RetryAfter != 2*time.Minute {
+		t.Fatalf("Expected a RateLimitError with RetryAfter, got %v", err)
+	}
+	if len(*sleeps) != 0 {
+		t.Errorf("Expected not to wait for Retry-After, got %v", *sleeps)
+	}
+}
+
+func TestClientServerErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, sleeps := newTestClient(server)
+	_, err := client.GetDevice("token", "device-1")
+	if err != nil {
+		t.Fatalf("Expected the GET to succeed after retrying, got %s", err)
+	}
+	if len(*sleeps) != 2 {
+		t.Errorf("Expected 2 retries, got %d", len(*sleeps))
+	}
+
+	// Commands aren't retried, as they may have been applied
+	requests = 0
+	err = client.ExecuteCommand("token", "device-1", GetSetHeatCommandRequest(21))
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected the command not to be retried, got %d requests", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if wait := parseRetryAfter("30"); wait != 30*time.Second {
+		t.Errorf("Expected 30s, got %s", wait)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(date); wait < 50*time.Second || wait > time.Minute {
+		t.Errorf("Expected about a minute, got %s", wait)
+	}
+	if wait := parseRetryAfter("soon"); wait != 0 {
+		t.Errorf("Expected 0 for an invalid value, got %s", wait)
+	}
+}
+
+func TestClientAPIErrors(t *testing.T) {
+	tests := []struct {
+		code     int
+		body     string
+		expected error
+	}{
+		{http.StatusBadRequest, `{"error": {"code": 400, "message": "Command not allowed in current thermostat mode.", "status": "FAILED_PRECONDITION"}}`, ErrFailedPrecondition},
+		{http.StatusBadRequest, `{"error": {"code": 400, "message": "Invalid command.", "status": "INVALID_ARGUMENT"}}`, ErrInvalidArgument},
+		{http.StatusUnauthorized, `{"error": {"code": 401, "message": "Request had invalid authentication credentials.", "status": "UNAUTHENTICATED"}}`, ErrUnauthenticated},
+		{http.StatusForbidden, `{"error": {"code": 403, "message": "Permission denied.", "status": "PERMISSION_DENIED"}}`, ErrPermissionDenied},
+		{http.StatusNotFound, `Not Found`, ErrNotFound},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.code)
+			w.Write([]byte(test.body))
+		}))
+		client, _ := newTestClient(server)
+		err := client.ExecuteCommand("token", "device-1", GetSetHeatCommandRequest(21))
+		server.Close()
+		if !errors.Is(err, test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.body, err)
+		}
+		var apiError *APIError
+		if !errors.As(err, &apiError) || apiError.StatusCode != test.code {
+			t.Errorf("Expected an APIError with status code %d, got %v", test.code, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package nest
+
+import (
+	"fmt"
+)
+
+// GetAmbientTemperature returns the temperature of the room the device is in
+func GetAmbientTemperature(client Client, accessToken string, deviceID string) (*float32, error) {
+	device, err := client.GetDevice(accessToken, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return &device.Traits.Temperature.Temperature, nil
+}
+
+// SetTemperature sets the temperature a device in HEAT mode heats to
+func SetTemperature(client Client, accessToken, deviceID string, temperature float32) error {
+	return client.ExecuteCommand(accessToken, deviceID, GetSetHeatCommandRequest(temperature))
+}
+
+// Setpoint is the target temperature(s) of a thermostat in a given mode. Only
+// HeatCelsius is used in HEAT mode, only CoolCelsius in COOL mode and both in
+// HEATCOOL mode.
+type Setpoint struct {
+	Mode        string  `json:"mode"`
+	HeatCelsius float32 `json:"heatCelsius"`
+	CoolCelsius float32 `json:"coolCelsius"`
+}
+
+// Primary returns the setpoint shown to users: the cool setpoint in COOL mode
+// and the heat setpoint otherwise.
+func (s Setpoint) Primary() float32 {
+	if s.Mode == ThermostatModeCool {
+		return s.CoolCelsius
+	}
+	return s.HeatCelsius
+}
+
+// String formats the setpoint for display, e.g. 21.0°C or 19.0-24.0°C
+func (s Setpoint) String() string {
+	if s.Mode == ThermostatModeHeatCool {
+		return fmt.Sprintf("%.1f-%.1f°C", s.HeatCelsius, s.CoolCelsius)
+	}
+	return fmt.Sprintf("%.1f°C", s.Primary())
+}
+
+// GetSetpoint returns the current mode and target temperature(s) of a device
+func GetSetpoint(client Client, accessToken, deviceID string) (*Setpoint, error) {
+	device, err := client.GetDevice(accessToken, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return SetpointFromTraits(device.Traits)
+}
+
+// SetpointFromTraits reads the setpoint from a device's traits
+func SetpointFromTraits(traits Traits) (*Setpoint, error) {
+	if traits.EcoEnabled() {
+		return nil, ErrEcoEnabled
+	}
+	mode := traits.ThermostatMode.Mode
+	trait := traits.ThermostatTemperatureSetpoint
+	setpoint := Setpoint{Mode: mode}
+	switch mode {
+	case ThermostatModeHeat:
+		if trait.HeatCelsius == nil {
+			return nil, fmt.Errorf("no heat setpoint found in mode %s", mode)
+		}
+		setpoint.HeatCelsius = *trait.HeatCelsius
+	case ThermostatModeCool:
+		if trait.CoolCelsius == nil {
+			return nil, fmt.Errorf("no cool setpoint found in mode %s", mode)
+		}
+		setpoint.CoolCelsius = *trait.CoolCelsius
+	case ThermostatModeHeatCool:
+		if trait.HeatCelsius == nil || trait.CoolCelsius == nil {
+			return nil, fmt.Errorf("no setpoint range found in mode %s", mode)
+		}
+		setpoint.HeatCelsius = *trait.HeatCelsius
+		setpoint.CoolCelsius = *trait.CoolCelsius
+	case ThermostatModeOff:
+		return nil, ErrThermostatOff
+	default:
+		return nil, fmt.Errorf("unsupported thermostat mode: %s", mode)
+	}
+	return &setpoint, nil
+}
+
+// SetSetpoint sets the target temperature(s) using the command for the mode
+// of the setpoint
+func SetSetpoint(client Client, accessToken, deviceID string, setpoint Setpoint) error {
+	command, err := GetSetpointCommandRequest(setpoint)
+	if err != nil {
+		return err
+	}
+	return client.ExecuteCommand(accessToken, deviceID, command)
+}
+
+// SetMode changes the mode of the thermostat, e.g. to HEAT or OFF
+func SetMode(client Client, accessToken, deviceID, mode string) error {
+	return client.ExecuteCommand(accessToken, deviceID, GetSetModeCommandRequest(mode))
+}
+
+// SetEcoMode turns eco mode on (MANUAL_ECO) or OFF
+func SetEcoMode(client Client, accessToken, deviceID, mode string) error {
+	return client.ExecuteCommand(accessToken, deviceID, GetSetEcoModeCommandRequest(mode))
+}
+
+func GetSetpointCommandRequest(setpoint Setpoint) (ExecuteCommandRequest, error) {
+	switch setpoint.Mode {
+	case ThermostatModeHeat:
+		return GetSetHeatCommandRequest(setpoint.HeatCelsius), nil
+	case ThermostatModeCool:
+		return GetSetCoolCommandRequest(setpoint.CoolCelsius), nil
+	case ThermostatModeHeatCool:
+		return GetSetRangeCommandRequest(setpoint.HeatCelsius, setpoint.CoolCelsius), nil
+	default:
+		return ExecuteCommandRequest{}, fmt.Errorf("unable to set the temperature in mode %s", setpoint.Mode)
+	}
+}
+
+func GetSetHeatCommandRequest(temperature float32) ExecuteCommandRequest {
+	return ExecuteCommandRequest{
+		Command: "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat",
+		Params: map[string]interface{}{
+			"heatCelsius": temperature,
+		},
+	}
+}
+
+func GetSetCoolCommandRequest(temperature float32) ExecuteCommandRequest {
+	return ExecuteCommandRequest{
+		Command: "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool",
+		Params: map[string]interface{}{
+			"coolCelsius": temperature,
+		},
+	}
+}
+
+func GetSetRangeCommandRequest(heat, cool float32) ExecuteCommandRequest {
+	return ExecuteCommandRequest{
+		Command: "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange",
+		Params: map[string]interface{}{
+			"heatCelsius": heat,
+			"coolCelsius": cool,
+		},
+	}
+}
+
+func GetSetModeCommandRequest(mode string) ExecuteCommandRequest {
+	return ExecuteCommandRequest{
+		Command: "sdm.devices.commands.ThermostatMode.SetMode",
+		Params: map[string]interface{}{
+			"mode": mode,
+		},
+	}
+}
+
+func GetSetEcoModeCommandRequest(mode string) ExecuteCommandRequest {
+	return ExecuteCommandRequest{
+		Command: "sdm.devices.commands.ThermostatEco.SetMode",
+		Params: map[string]interface{}{
+			"mode": mode,
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package nest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Errors returned by the SDM API, which an *APIError matches with errors.Is
+var (
+	// ErrUnauthenticated is returned when the access token is invalid or has
+	// expired
+	ErrUnauthenticated = errors.New("the access token was rejected")
+	// ErrPermissionDenied is returned when the user has removed access to
+	// their devices, or to the device being used
+	ErrPermissionDenied = errors.New("permission to the device was denied")
+	// ErrNotFound is returned when the device doesn't exist, e.g. because it
+	// has been removed from the user's account
+	ErrNotFound = errors.New("the device was not found")
+	// ErrFailedPrecondition is returned when a command can't be run in the
+	// device's current state, e.g. setting the cool setpoint in HEAT mode
+	ErrFailedPrecondition = errors.New("the command isn't allowed in the device's current state")
+	// ErrInvalidArgument is returned for a malformed command
+	ErrInvalidArgument = errors.New("the command was invalid")
+	// ErrUnavailable is returned when the device is offline, or Google returns
+	// a server error or can't be reached, even after retrying
+	ErrUnavailable = errors.New("the Nest API is unavailable")
+)
+
+// APIError is an error response from the SDM API
+type APIError struct {
+	StatusCode int
+	// Status is Google's name for the error, e.g. FAILED_PRECONDITION
+	Status  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("got an error response from Nest: %d %s", e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("got an error response from Nest: %s", e.Message)
+}
+
+// Is matches the error to one of the sentinel errors by Google's status, or
+// by the HTTP status code if the body couldn't be parsed
+func (e *APIError) Is(target error) bool {
+	switch e.Status {
+	case "UNAUTHENTICATED":
+		return target == ErrUnauthenticated
+	case "PERMISSION_DENIED":
+		return target == ErrPermissionDenied
+	case "NOT_FOUND":
+		return target == ErrNotFound
+	case "FAILED_PRECONDITION":
+		return target == ErrFailedPrecondition
+	case "INVALID_ARGUMENT":
+		return target == ErrInvalidArgument
+	case "UNAVAILABLE", "INTERNAL", "DEADLINE_EXCEEDED":
+		return target == ErrUnavailable
+	case "RESOURCE_EXHAUSTED":
+		return target == ErrRateLimit
+	}
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return target == ErrUnauthenticated
+	case e.StatusCode == http.StatusForbidden:
+		return target == ErrPermissionDenied
+	case e.StatusCode == http.StatusNotFound:
+		return target == ErrNotFound
+	case e.StatusCode >= 500:
+		return target == ErrUnavailable
+	}
+	return false
+}
+
+// parseAPIError reads Google's error format, e.g.
+// {"error": {"code": 400, "message": "...", "status": "FAILED_PRECONDITION"}}
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiError := &APIError{StatusCode: statusCode}
+	var response struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Error.Status == "" {
+		apiError.Message = string(body)
+		return apiError
+	}
+	apiError.Status = response.Error.Status
+	apiError.Message = response.Error.Message
+	return apiError
+}
+
+// RateLimitError is returned when Google rejects a request for going over the
+// quota for the project, and matches ErrRateLimit with errors.Is. RetryAfter
+// is how long Google asked us to wait, or zero if it didn't say.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry after %s", ErrRateLimit, e.RetryAfter)
+	}
+	return ErrRateLimit.Error()
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimit
+}
+
+// unavailableError wraps a network error, matching ErrUnavailable
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnavailable, e.err)
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
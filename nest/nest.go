@@ -0,0 +1,167 @@
+// Package nest is a client for the Google Smart Device Management API, used to
+// control Nest thermostats.
+package nest
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+var (
+	deviceIdRegexp = regexp.MustCompile(".*/([a-zA-Z0-9-_]*)$")
+	ErrRateLimit   = errors.New("too many requests")
+	// ErrThermostatOff is returned when trying to read or change the
+	// temperature of a thermostat which is turned off
+	ErrThermostatOff = errors.New("thermostat is turned off")
+	// ErrEcoEnabled is returned when trying to read or change the temperature
+	// of a thermostat in eco mode, as it uses the eco temperatures instead
+	ErrEcoEnabled = errors.New("thermostat is in eco mode")
+)
+
+type ParentRelation struct {
+	Parent      string `json:"parent"`
+	DisplayName string `json:"displayName"`
+}
+
+type Device struct {
+	Name            string           `json:"name"`
+	Type            string           `json:"type"`
+	Traits          Traits           `json:"traits"`
+	ParentRelations []ParentRelation `json:"parentRelations"`
+}
+
+func (d *Device) IsThermostat() bool {
+	return d.Type == "sdm.devices.types.THERMOSTAT"
+}
+
+// DeviceID returns the last part of the device's name, or the whole name if it
+// isn't in the format enterprises/<project>/devices/<id>
+func (d *Device) DeviceID() string {
+	names := deviceIdRegexp.FindStringSubmatch(d.Name)
+	if names == nil {
+		return d.Name
+	}
+	return names[len(names)-1]
+}
+
+func (d *Device) DisplayName() string {
+	for _, parent := range d.ParentRelations {
+		if parent.DisplayName != "" {
+			return parent.DisplayName
+		}
+	}
+	// Default, incase displayName cannot be found
+	return d.DeviceID()
+}
+
+type Devices struct {
+	Devices []Device `json:"devices"`
+}
+
+func (d *Devices) GetThermostats() []Device {
+	response := make([]Device, 0, len(d.Devices))
+	for _, device := range d.Devices {
+		if device.IsThermostat() {
+			response = append(response, device)
+		}
+	}
+	return response
+}
+
+const (
+	ThermostatModeHeat     = "HEAT"
+	ThermostatModeCool     = "COOL"
+	ThermostatModeHeatCool = "HEATCOOL"
+	ThermostatModeOff      = "OFF"
+
+	EcoModeManual = "MANUAL_ECO"
+	EcoModeOff    = "OFF"
+
+	HvacStatusOff     = "OFF"
+	HvacStatusHeating = "HEATING"
+	HvacStatusCooling = "COOLING"
+
+	ConnectivityOnline  = "ONLINE"
+	ConnectivityOffline = "OFFLINE"
+
+	TemperatureScaleCelsius    = "CELSIUS"
+	TemperatureScaleFahrenheit = "FAHRENHEIT"
+)
+
+type InfoTrait struct {
+	CustomName string `json:"customName"`
+}
+
+type HumidityTrait struct {
+	AmbientHumidityPercent float32 `json:"ambientHumidityPercent"`
+}
+
+type ConnectivityTrait struct {
+	Status string `json:"status"`
+}
+
+type FanTrait struct {
+	TimerMode    string    `json:"timerMode"`
+	TimerTimeout time.Time `json:"timerTimeout"`
+}
+
+type ThermostatModeTrait struct {
+	Mode           string   `json:"mode"`
+	AvailableModes []string `json:"availableModes"`
+}
+
+// ThermostatEcoTrait holds the eco settings. The setpoints only apply while
+// Mode is MANUAL_ECO.
+type ThermostatEcoTrait struct {
+	Mode           string   `json:"mode"`
+	AvailableModes []string `json:"availableModes"`
+	HeatCelsius    float32  `json:"heatCelsius"`
+	CoolCelsius    float32  `json:"coolCelsius"`
+}
+
+type ThermostatHvacTrait struct {
+	Status string `json:"status"`
+}
+
+type SettingsTrait struct {
+	TemperatureScale string `json:"temperatureScale"`
+}
+
+type TemperatureTrait struct {
+	Temperature float32 `json:"ambientTemperatureCelsius"`
+}
+
+// ThermostatTemperatureSetpointTrait holds the target temperatures. Which of
+// these are set depends on the thermostat mode, e.g. only HeatCelsius in HEAT
+// mode and both in HEATCOOL mode.
+type ThermostatTemperatureSetpointTrait struct {
+	HeatCelsius *float32 `json:"heatCelsius"`
+	CoolCelsius *float32 `json:"coolCelsius"`
+}
+
+type Traits struct {
+	Info                          InfoTrait                          `json:"sdm.devices.traits.Info"`
+	Humidity                      HumidityTrait                      `json:"sdm.devices.traits.Humidity"`
+	Connectivity                  ConnectivityTrait                  `json:"sdm.devices.traits.Connectivity"`
+	Fan                           FanTrait                           `json:"sdm.devices.traits.Fan"`
+	ThermostatMode                ThermostatModeTrait                `json:"sdm.devices.traits.ThermostatMode"`
+	ThermostatEco                 ThermostatEcoTrait                 `json:"sdm.devices.traits.ThermostatEco"`
+	ThermostatHvac                ThermostatHvacTrait                `json:"sdm.devices.traits.ThermostatHvac"`
+	Settings                      SettingsTrait                      `json:"sdm.devices.traits.Settings"`
+	Temperature                   TemperatureTrait                   `json:"sdm.devices.traits.Temperature"`
+	ThermostatTemperatureSetpoint ThermostatTemperatureSetpointTrait `json:"sdm.devices.traits.ThermostatTemperatureSetpoint"`
+}
+
+func (t *Traits) IsOnline() bool {
+	return t.Connectivity.Status == ConnectivityOnline
+}
+
+func (t *Traits) EcoEnabled() bool {
+	return t.ThermostatEco.Mode == EcoModeManual
+}
+
+type ExecuteCommandRequest struct {
+	Command string                 `json:"command"`
+	Params  map[string]interface{} `json:"params"`
+}
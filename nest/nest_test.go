@@ -0,0 +1,186 @@
+package nest
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func loadFixture(t *testing.T, name string, value interface{}) {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %s", name, err)
+	}
+	err = json.Unmarshal(body, value)
+	if err != nil {
+		t.Fatalf("Failed to decode fixture %s: %s", name, err)
+	}
+}
+
+func TestDecodeDevices(t *testing.T) {
+	devices := Devices{}
+	loadFixture(t, "devices.json", &devices)
+	if len(devices.Devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(devices.Devices))
+	}
+	device := devices.Devices[0]
+	if !device.IsThermostat() || devices.Devices[1].IsThermostat() {
+		t.Errorf("Expected only the first device to be a thermostat")
+	}
+	if device.DeviceID() != "AVPHwEv-thermostat-1" {
+		t.Errorf("Unexpected device ID: %s", device.DeviceID())
+	}
+	if device.DisplayName() != "Hallway" {
+		t.Errorf("Unexpected display name: %s", device.DisplayName())
+	}
+
+	traits := device.Traits
+	if traits.Humidity.AmbientHumidityPercent != 54 {
+		t.Errorf("Unexpected humidity: %f", traits.Humidity.AmbientHumidityPercent)
+	}
+	if !traits.IsOnline() {
+		t.Errorf("Expected device to be online")
+	}
+	if traits.ThermostatMode.Mode != ThermostatModeHeat || len(traits.ThermostatMode.AvailableModes) != 2 {
+		t.Errorf("Unexpected thermostat mode: %v", traits.ThermostatMode)
+	}
+	if traits.EcoEnabled() || traits.ThermostatEco.HeatCelsius != 12.6 {
+		t.Errorf("Unexpected eco trait: %v", traits.ThermostatEco)
+	}
+	if traits.ThermostatHvac.Status != HvacStatusHeating {
+		t.Errorf("Unexpected HVAC status: %s", traits.ThermostatHvac.Status)
+	}
+	if traits.Settings.TemperatureScale != TemperatureScaleCelsius {
+		t.Errorf("Unexpected temperature scale: %s", traits.Settings.TemperatureScale)
+	}
+	if traits.Temperature.Temperature != 18.21 {
+		t.Errorf("Unexpected ambient temperature: %f", traits.Temperature.Temperature)
+	}
+	setpoint := traits.ThermostatTemperatureSetpoint
+	if setpoint.HeatCelsius == nil || *setpoint.HeatCelsius != 19.5 {
+		t.Errorf("Unexpected heat setpoint: %v", setpoint.HeatCelsius)
+	}
+	if setpoint.CoolCelsius != nil {
+		t.Errorf("Expected no cool setpoint in HEAT mode, got %f", *setpoint.CoolCelsius)
+	}
+}
+
+func TestGetThermostats(t *testing.T) {
+	devices := Devices{}
+	loadFixture(t, "devices.json", &devices)
+	thermostats := devices.GetThermostats()
+	if len(thermostats) != 1 || thermostats[0].DeviceID() != "AVPHwEv-thermostat-1" {
+		t.Errorf("Expected only the thermostat, got %v", thermostats)
+	}
+}
+
+func TestDeviceIDUnexpectedName(t *testing.T) {
+	device := Device{Name: "thermostat"}
+	if device.DeviceID() != "thermostat" {
+		t.Errorf("Expected the name as the device ID, got %s", device.DeviceID())
+	}
+}
+
+func TestDecodeHeatCoolDevice(t *testing.T) {
+	device := Device{}
+	loadFixture(t, "device_heatcool.json", &device)
+	traits := device.Traits
+	if traits.Info.CustomName != "Upstairs" {
+		t.Errorf("Unexpected custom name: %s", traits.Info.CustomName)
+	}
+	if traits.IsOnline() {
+		t.Errorf("Expected device to be offline")
+	}
+	if traits.Fan.TimerMode != "ON" || !traits.Fan.TimerTimeout.Equal(time.Date(2024, 5, 10, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected fan trait: %v", traits.Fan)
+	}
+	if traits.ThermostatMode.Mode != ThermostatModeHeatCool {
+		t.Errorf("Unexpected thermostat mode: %s", traits.ThermostatMode.Mode)
+	}
+	if traits.EcoEnabled() {
+		t.Errorf("Expected eco to be disabled")
+	}
+	if traits.ThermostatHvac.Status != HvacStatusCooling {
+		t.Errorf("Unexpected HVAC status: %s", traits.ThermostatHvac.Status)
+	}
+	if traits.Settings.TemperatureScale != TemperatureScaleFahrenheit {
+		t.Errorf("Unexpected temperature scale: %s", traits.Settings.TemperatureScale)
+	}
+	setpoint := traits.ThermostatTemperatureSetpoint
+	if setpoint.HeatCelsius == nil || *setpoint.HeatCelsius != 20 || setpoint.CoolCelsius == nil || *setpoint.CoolCelsius != 24.5 {
+		t.Errorf("Unexpected setpoints: %v", setpoint)
+	}
+}
+
+func TestSetpointFromTraits(t *testing.T) {
+	devices := Devices{}
+	loadFixture(t, "devices.json", &devices)
+	setpoint, err := SetpointFromTraits(devices.Devices[0].Traits)
+	if err != nil {
+		t.Fatalf("Failed to get setpoint: %s", err)
+	}
+	if *setpoint != (Setpoint{Mode: ThermostatModeHeat, HeatCelsius: 19.5}) {
+		t.Errorf("Unexpected setpoint: %v", setpoint)
+	}
+
+	device := Device{}
+	loadFixture(t, "device_heatcool.json", &device)
+	setpoint, err = SetpointFromTraits(device.Traits)
+	if err != nil {
+		t.Fatalf("Failed to get setpoint: %s", err)
+	}
+	if *setpoint != (Setpoint{Mode: ThermostatModeHeatCool, HeatCelsius: 20, CoolCelsius: 24.5}) {
+		t.Errorf("Unexpected setpoint: %v", setpoint)
+	}
+	if setpoint.String() != "20.0-24.5°C" {
+		t.Errorf("Unexpected description: %s", setpoint)
+	}
+
+	device.Traits.ThermostatMode.Mode = ThermostatModeOff
+	_, err = SetpointFromTraits(device.Traits)
+	if err != ErrThermostatOff {
+		t.Errorf("Expected ErrThermostatOff, got %v", err)
+	}
+}
+
+func TestSetpointFromTraitsEco(t *testing.T) {
+	device := Device{}
+	loadFixture(t, "device_eco.json", &device)
+	if !device.Traits.EcoEnabled() {
+		t.Fatalf("Expected eco to be enabled")
+	}
+	_, err := SetpointFromTraits(device.Traits)
+	if err != ErrEcoEnabled {
+		t.Errorf("Expected ErrEcoEnabled, got %v", err)
+	}
+}
+
+func TestGetSetpointCommandRequest(t *testing.T) {
+	tests := []struct {
+		setpoint Setpoint
+		command  string
+	}{
+		{Setpoint{Mode: ThermostatModeHeat, HeatCelsius: 21}, "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat"},
+		{Setpoint{Mode: ThermostatModeCool, CoolCelsius: 21}, "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool"},
+		{Setpoint{Mode: ThermostatModeHeatCool, HeatCelsius: 19, CoolCelsius: 24}, "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange"},
+	}
+	for _, test := range tests {
+		request, err := GetSetpointCommandRequest(test.setpoint)
+		if err != nil {
+			t.Fatalf("Failed to get command: %s", err)
+		}
+		if request.Command != test.command {
+			t.Errorf("Expected %s, got %s", test.command, request.Command)
+		}
+	}
+	rangeRequest, _ := GetSetpointCommandRequest(Setpoint{Mode: ThermostatModeHeatCool, HeatCelsius: 19, CoolCelsius: 24})
+	if rangeRequest.Params["heatCelsius"] != float32(19) || rangeRequest.Params["coolCelsius"] != float32(24) {
+		t.Errorf("Unexpected params: %v", rangeRequest.Params)
+	}
+	_, err := GetSetpointCommandRequest(Setpoint{Mode: ThermostatModeOff})
+	if err == nil {
+		t.Errorf("Expected an error in OFF mode")
+	}
+}
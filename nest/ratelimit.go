@@ -0,0 +1,80 @@
+package nest
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket used to keep requests under Google's quota
+// for the project. Tokens are added at a steady rate up to a maximum burst,
+// and each request takes one.
+type RateLimiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	burst    float64
+	interval time.Duration
+	last     time.Time
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+// NewRateLimiter returns a limiter allowing perMinute requests a minute on
+// average, with up to burst requests at once.
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if perMinute < 1 {
+		perMinute = 1
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		tokens:   float64(burst),
+		burst:    float64(burst),
+		interval: time.Minute / time.Duration(perMinute),
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// refill adds the tokens earned since the last call. The caller must hold l.mu.
+func (l *RateLimiter) refill() {
+	now := l.now()
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Allow takes a token if one is available, without waiting
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Reserve takes a token, returning how long the caller must wait before
+// using it
+func (l *RateLimiter) Reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens * float64(l.interval))
+}
+
+// Wait blocks until a token is available
+func (l *RateLimiter) Wait() {
+	if wait := l.Reserve(); wait > 0 {
+		l.sleep(wait)
+	}
+}
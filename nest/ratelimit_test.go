@@ -0,0 +1,41 @@
+package nest
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(perMinute, burst int) (*RateLimiter, *time.Time) {
+	now := time.Now()
+	limiter := NewRateLimiter(perMinute, burst)
+	limiter.last = now
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter, now := newTestRateLimiter(60, 2)
+	if !limiter.Allow() || !limiter.Allow() {
+		t.Fatalf("Expected a burst of 2 requests to be allowed")
+	}
+	if limiter.Allow() {
+		t.Errorf("Expected the third request to be limited")
+	}
+	*now = now.Add(time.Second)
+	if !limiter.Allow() {
+		t.Errorf("Expected a request to be allowed after a token was added")
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	limiter, _ := newTestRateLimiter(60, 1)
+	if wait := limiter.Reserve(); wait != 0 {
+		t.Errorf("Expected no wait, got %s", wait)
+	}
+	if wait := limiter.Reserve(); wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %s", wait)
+	}
+	if wait := limiter.Reserve(); wait != 2*time.Second {
+		t.Errorf("Expected to wait 2s, got %s", wait)
+	}
+}
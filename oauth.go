@@ -1,8 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,20 +13,56 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	flash "github.com/andyfoston/nest-heating-boost/flash"
+	"github.com/gorilla/securecookie"
 )
 
+// Before the vault the cookie held the authorization code and refresh token.
+// These sign in as the admin of a household the next time the cookie is read.
 const (
 	authorizationCodeKey = "authorizationCode"
 	refreshTokenKey      = "refresh_token"
 )
 
-func hasAuthorizationCode(values map[string]string) bool {
-	authCode, authOk := values[authorizationCodeKey]
-	refreshToken, refreshOk := values[refreshTokenKey]
-	return authOk && refreshOk && authCode != "" && refreshToken != ""
+// sdmScope allows the app to see and control the thermostats the user shares
+const sdmScope = "https://www.googleapis.com/auth/sdm.service"
+
+// ErrInvalidGrant is returned when Google rejects a refresh token, usually
+// because the user has removed the app's access in their Google account
+var ErrInvalidGrant = errors.New("access to Nest has been revoked in Google")
+
+// oauthError is an error response from the OAuth token endpoint
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Code == "invalid_grant" {
+		return fmt.Sprintf("%s: %s", ErrInvalidGrant, e.Description)
+	}
+	return fmt.Sprintf("unexpected response: %s: %s", e.Code, e.Description)
+}
+
+func (e *oauthError) Is(target error) bool {
+	return target == ErrInvalidGrant && e.Code == "invalid_grant"
+}
+
+// tokenErrorFlash explains a failure to get an access token to the user
+func tokenErrorFlash(err error) flash.Flash {
+	if !errors.Is(err, ErrInvalidGrant) {
+		return flash.Flash{
+			Level:   flash.WARN,
+			Message: "Unable to get access to Nest. Please authorize access to Nest again",
+		}
+	}
+	return flash.Flash{
+		Level:   flash.ERROR,
+		Message: "Access to your thermostats has been removed in Google, so scheduled and running boosts have been stopped and recurring boosts paused. Access to Nest needs to be authorized again",
+	}
 }
 
 func getRedirectURL(r *http.Request) string {
@@ -38,7 +77,80 @@ func getRedirectURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s/code", scheme, r.Host)
 }
 
+// The nonce in the state sent to Google and the PKCE code verifier are held in
+// the cookie until Google redirects back to /code
+const (
+	oauthStateKey    = "oauthState"
+	oauthVerifierKey = "oauthVerifier"
+	// oauthStateName is the name the state is signed with, so that other
+	// values signed with the cookie keys can't be passed off as a state
+	oauthStateName   = "oauth-state"
+	oauthStateExpiry = 10 * time.Minute
+)
+
+var ErrOAuthState = errors.New("the authorization has expired, or was started by someone else")
+
+// oauthState is sent to Google signed and encrypted with the cookie keys.
+// Google sends it back to /code, where it has to match the user and the nonce
+// in their cookie, so that nobody can get an admin to store the refresh token
+// for someone else's Nest account.
+type oauthState struct {
+	Nonce   string
+	UserID  string
+	Expires time.Time
+}
+
+// startAuthorization returns the state and PKCE code challenge to send to
+// Google, keeping what's needed to check them in the cookie
+func startAuthorization(w http.ResponseWriter, data map[string]string, user *User) (state, challenge string, err error) {
+	nonce := newID()
+	verifier := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	state, err = securecookie.EncodeMulti(oauthStateName, oauthState{
+		Nonce:   nonce,
+		UserID:  user.ID,
+		Expires: time.Now().Add(oauthStateExpiry),
+	}, cookieCodecs...)
+	if err != nil {
+		return "", "", err
+	}
+	data[oauthStateKey] = nonce
+	data[oauthVerifierKey] = verifier
+	err = setCookie(data, w)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return state, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// verifyOAuthState checks the state Google redirected back with was sent for
+// this user from this browser
+func verifyOAuthState(encoded string, data map[string]string, user *User) error {
+	state := oauthState{}
+	if err := securecookie.DecodeMulti(oauthStateName, encoded, &state, cookieCodecs...); err != nil {
+		return fmt.Errorf("%w: %s", ErrOAuthState, err)
+	}
+	nonce := data[oauthStateKey]
+	switch {
+	case time.Now().After(state.Expires):
+		return fmt.Errorf("%w: expired at %s", ErrOAuthState, state.Expires.Format(time.RFC3339))
+	case nonce == "" || subtle.ConstantTimeCompare([]byte(nonce), []byte(state.Nonce)) != 1:
+		return fmt.Errorf("%w: nonce doesn't match the cookie", ErrOAuthState)
+	case state.UserID != user.ID:
+		return fmt.Errorf("%w: started by user %s", ErrOAuthState, state.UserID)
+	}
+	return nil
+}
+
 func AuthorizeAccess(w http.ResponseWriter, r *http.Request) {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	// Only admins can authorize access for their household
+	user, ok := userFromCookie(w, data)
+	canAuthorize := ok && user.IsAdmin()
+
 	files := []string{
 		"./templates/base.tmpl",
 		"./templates/authorize.tmpl",
@@ -50,25 +162,38 @@ func AuthorizeAccess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	redirectURL := getRedirectURL(r)
-	authURL, _ := url.Parse(fmt.Sprintf(
-		"https://nestservices.google.com/partnerconnections/%s/auth", projectID,
-	))
-	params := url.Values{
-		"redirect_uri":  {redirectURL},
-		"access_type":   {"offline"},
-		"prompt":        {"consent"},
-		"client_id":     {clientID},
-		"response_type": {"code"},
-		"scope":         {"https://www.googleapis.com/auth/sdm.service"},
+	var authURL string
+	if canAuthorize {
+		state, challenge, err := startAuthorization(w, data, user)
+		if err != nil {
+			log.Printf("Failed to start authorization: %s", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		redirectURL := getRedirectURL(r)
+		parsedURL, _ := url.Parse(fmt.Sprintf(
+			"%s/partnerconnections/%s/auth", partnerConnectionsURL, projectID,
+		))
+		params := url.Values{
+			"redirect_uri":          {redirectURL},
+			"access_type":           {"offline"},
+			"prompt":                {"consent"},
+			"client_id":             {clientID},
+			"response_type":         {"code"},
+			"scope":                 {sdmScope},
+			"state":                 {state},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+		parsedURL.RawQuery = params.Encode()
+		authURL = parsedURL.String()
 	}
-	authURL.RawQuery = params.Encode()
 
 	flashes, err := flash.GetFlashes(w, r)
 	if err != nil {
 		log.Print(err.Error())
 	}
-	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{"authorizeURL": authURL, "Flashes": flashes})
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{"authorizeURL": authURL, "canAuthorize": canAuthorize, "Flashes": flashes})
 	if err != nil {
 		log.Print(err.Error())
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -94,51 +219,184 @@ func code(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO. Handle parsedQuery["error"] ...
-	// https://developers.google.com/identity/protocols/oauth2/web-server#authorization-errors
+	user, ok := userFromCookie(w, data)
+	if !ok || !user.IsAdmin() {
+		http.Error(w, "Only an admin of your household can authorize access to Nest", http.StatusForbidden)
+		return
+	}
+	err = verifyOAuthState(parsedQuery.Get("state"), data, user)
+	if err != nil {
+		authorizeErrorPage(w, r, http.StatusBadRequest, "invalid_state", err.Error())
+		return
+	}
+	// The state and code verifier can only be used once
+	verifier := data[oauthVerifierKey]
+	delete(data, oauthStateKey)
+	delete(data, oauthVerifierKey)
+	err = setCookie(data, w)
+	if err != nil {
+		log.Printf("Failed to set cookie: %s", err)
+	}
 
-	if code, ok := parsedQuery["code"]; ok {
-		data[authorizationCodeKey] = code[0]
-		token, err := GetTokenFromAuthCode(code[0], getRedirectURL(r))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error: %s", err), http.StatusInternalServerError)
-			return
+	// https://developers.google.com/identity/protocols/oauth2/web-server#authorization-errors
+	if errorCode := parsedQuery.Get("error"); errorCode != "" {
+		authorizeErrorPage(w, r, http.StatusBadRequest, errorCode, parsedQuery.Get("error_description"))
+		return
+	}
+	code := parsedQuery.Get("code")
+	if code == "" {
+		authorizeErrorPage(w, r, http.StatusBadRequest, "invalid_request", "missing code in "+parsedURL.RawQuery)
+		return
+	}
+	token, err := GetTokenFromAuthCode(code, getRedirectURL(r), verifier)
+	if err != nil {
+		oauthErr := &oauthError{}
+		if errors.As(err, &oauthErr) {
+			authorizeErrorPage(w, r, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+		} else {
+			authorizeErrorPage(w, r, http.StatusInternalServerError, "server_error", err.Error())
 		}
-		// Initial call required
-		GetDevices(token.AccessToken)
-		data[refreshTokenKey] = token.RefreshToken
-		setCookie(data, w)
-		flashes := make([]flash.Flash, 0, 1)
-		flashes = append(flashes, flash.Flash{
-			Level:   flash.INFO,
-			Message: "Successfully authenticated with Google",
-		})
-		flash.SetFlashes(w, flashes)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-	} else if errorCode, ok := parsedQuery["error"]; ok {
-		w.Write([]byte(fmt.Sprintf("Got an error response from Google: %s", errorCode[0])))
-	} else {
-		log.Printf("Missing code from URL: %s", parsedURL.RawQuery)
+		return
+	}
+	if !token.HasScope(sdmScope) {
+		authorizeErrorPage(w, r, http.StatusBadRequest, "missing_scope", "granted "+token.Scope)
+		return
+	}
+	// Initial call required
+	devices, err := nestClient.ListDevices(token.AccessToken)
+	if err != nil {
+		log.Printf("Failed to list devices after authorizing: %s", err)
+	} else if len(devices.Devices) == 0 {
+		authorizeErrorPage(w, r, http.StatusBadRequest, "no_devices", "no devices were shared")
+		return
+	}
+	// An admin authorizing again replaces the household's refresh token,
+	// so everyone in it and its boosts carry on with the new one
+	householdID := user.HouseholdID
+	err = vault.Put(householdID, token.RefreshToken)
+	if err != nil {
+		log.Printf("Failed to store refresh token: %s", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
+	accessTokens.Forget(householdID)
+	devicesCache.Refresh(householdID)
+	flashes := make([]flash.Flash, 0, 1)
+	flashes = append(flashes, flash.Flash{
+		Level:   flash.INFO,
+		Message: "Successfully authenticated with Google",
+	})
+	flash.SetFlashes(w, flashes)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// authorizeErrorMessages explain the errors Google redirects back to /code
+// with or returns for the code, along with the ones /code finds itself
+var authorizeErrorMessages = map[string]string{
+	"access_denied":         "Access to Nest wasn't allowed. To boost your heating, allow this app to see and control your thermostats when Google asks.",
+	"admin_policy_enforced": "Your Google Workspace administrator doesn't allow this app to access your Google account.",
+	"invalid_client":        "Google doesn't recognise this app. Check CLIENT_ID and CLIENT_SECRET are for the OAuth client linked to your Device Access project.",
+	"unauthorized_client":   "Google doesn't recognise this app. Check CLIENT_ID and CLIENT_SECRET are for the OAuth client linked to your Device Access project.",
+	"invalid_scope":         "Google wouldn't give access to control thermostats. Check the Smart Device Management API is enabled, and the OAuth consent screen includes the sdm.service scope.",
+	"missing_scope":         "Permission to see and control your thermostats wasn't given. Make sure it's ticked when Google asks which permissions to allow.",
+	"no_devices":            "No thermostats were shared with this app. When Google asks which devices to allow access to, select your thermostats.",
+	"invalid_grant":         "The authorization expired before it could be completed.",
+	"invalid_state":         "The authorization expired, or wasn't started in this browser.",
+	"invalid_request":       "Google redirected back without authorizing access.",
+}
+
+// authorizeErrorMessage explains an authorization error to the user
+func authorizeErrorMessage(code, redirectURL string) string {
+	if code == "redirect_uri_mismatch" {
+		return fmt.Sprintf("Google doesn't allow redirecting back to this app at %s. Add it to the authorized redirect URIs of the OAuth client, or set OVERRIDE_REDIRECT_URL to one that is.", redirectURL)
+	}
+	if message, ok := authorizeErrorMessages[code]; ok {
+		return message
+	}
+	return "Google was unable to authorize access to Nest."
+}
+
+// authorizeErrorPage logs why access to Nest couldn't be authorized, and
+// explains it to the user with a link to try again
+func authorizeErrorPage(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	log.Printf("Failed to authorize access to Nest: %s: %s", code, description)
+	files := []string{
+		"./templates/base.tmpl",
+		"./templates/authorize_error.tmpl",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{"Code": code, "Message": authorizeErrorMessage(code, getRedirectURL(r))})
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// tokenExpirySkew is how long before its expiry an access token is treated as
+// expired, so that it doesn't expire while a request is in flight
+const tokenExpirySkew = time.Minute
+
 type Token struct {
-	AccessToken    string `json:"access_token"`
-	ExpiresIn      int64  `json:"expires_in"`
-	RefreshToken   string `json:"refresh_token"`
-	tokenRequested time.Time
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	// Scope is the space separated scopes the user allowed access to
+	Scope string `json:"scope"`
+	// Expiry is when the access token expires, worked out from ExpiresIn when
+	// the token was issued
+	Expiry time.Time `json:"-"`
+}
+
+// HasScope reports whether the user allowed access to the scope. Tokens which
+// don't list their scopes are assumed to have the ones asked for.
+func (t *Token) HasScope(scope string) bool {
+	if t.Scope == "" {
+		return true
+	}
+	for _, granted := range strings.Fields(t.Scope) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the access token has expired, or will within
+// tokenExpirySkew. A token without an expiry is treated as expired.
+func (t *Token) Expired() bool {
+	return t.expiredAt(time.Now())
+}
+
+func (t *Token) expiredAt(now time.Time) bool {
+	if t.Expiry.IsZero() {
+		return true
+	}
+	return !now.Before(t.Expiry.Add(-tokenExpirySkew))
 }
 
-func (t *Token) TokenValid() bool {
-	return t.tokenRequested.Add(time.Second * time.Duration(t.ExpiresIn)).Before(time.Now())
+// Valid reports whether there is an access token which hasn't expired
+func (t *Token) Valid() bool {
+	return t.validAt(time.Now())
 }
 
-func _authenticate(uri string) (*Token, error) {
-	req, err := http.NewRequest("POST", uri, bytes.NewReader([]byte{}))
+func (t *Token) validAt(now time.Time) bool {
+	return t != nil && t.AccessToken != "" && !t.expiredAt(now)
+}
+
+// _authenticate posts the form to the token endpoint. The credentials are sent
+// in the body, so that they don't end up in logs of the URL.
+func _authenticate(form url.Values) (*Token, error) {
+	req, err := http.NewRequest("POST", oauthTokenURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -150,8 +408,12 @@ func _authenticate(uri string) (*Token, error) {
 		return nil, err
 	}
 
-	log.Printf("Authenticate uri: %s, status code: %d\n", uri, resp.StatusCode)
+	log.Printf("Authenticate endpoint: %s, grant type: %s, status code: %d\n", oauthTokenURL, form.Get("grant_type"), resp.StatusCode)
 	if resp.StatusCode >= 400 {
+		oauthErr := &oauthError{}
+		if json.Unmarshal(body, oauthErr) == nil && oauthErr.Code != "" {
+			return nil, oauthErr
+		}
 		return nil, fmt.Errorf("unexpected response: %s", body)
 	}
 
@@ -160,22 +422,28 @@ func _authenticate(uri string) (*Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	token.tokenRequested = time.Now()
+	token.Expiry = time.Now().Add(time.Second * time.Duration(token.ExpiresIn))
 	return &token, nil
 }
 
-func GetTokenFromAuthCode(authCode string, redirectURI string) (*Token, error) {
-	uri := fmt.Sprintf("https://www.googleapis.com/oauth2/v4/token?client_id=%s&client_secret=%s&code=%s&grant_type=authorization_code&redirect_uri=%s",
-		clientID, clientSecret, authCode, redirectURI,
-	)
-	return _authenticate(uri)
+func GetTokenFromAuthCode(authCode string, redirectURI string, codeVerifier string) (*Token, error) {
+	return _authenticate(url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code":          {authCode},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	})
 }
 
 func GetTokenFromRefreshToken(refreshToken string) (*Token, error) {
-	uri := fmt.Sprintf("https://www.googleapis.com/oauth2/v4/token?client_id=%s&client_secret=%s&refresh_token=%s&grant_type=refresh_token",
-		clientID, clientSecret, refreshToken,
-	)
-	token, err := _authenticate(uri)
+	token, err := _authenticate(url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+	})
 	if err == nil {
 		// re-inject refresh token into response
 		token.RefreshToken = refreshToken
@@ -184,6 +452,4 @@ func GetTokenFromRefreshToken(refreshToken string) (*Token, error) {
 	return token, err
 }
 
-// TODO implement token exchange: https://developers.google.com/identity/protocols/oauth2/web-server#exchange-authorization-code
-
 // View https://developers.google.com/nest/device-access/authorize
@@ -2,41 +2,72 @@ package main
 
 import (
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestHasAuthorizationCode(t *testing.T) {
-	values := map[string]string{
-		authorizationCodeKey: "authCode",
-		refreshTokenKey:      "refreshToken",
+func TestGetRedirectURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "example.com"
+	if getRedirectURL(r) != "http://example.com/code" {
+		t.Errorf("Expected http://example.com/code, got %s", getRedirectURL(r))
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	now := time.Now()
+	token := Token{AccessToken: "access", Expiry: now.Add(time.Hour)}
+	if token.expiredAt(now) || !token.validAt(now) {
+		t.Errorf("Expected a token expiring in an hour to be valid")
 	}
-	if !hasAuthorizationCode(values) {
-		t.Errorf("Expected true, got false")
+	if !token.expiredAt(now.Add(2 * time.Hour)) {
+		t.Errorf("Expected the token to have expired after its expiry")
+	}
+	// Treated as expired within the skew of its expiry
+	if !token.expiredAt(token.Expiry.Add(-tokenExpirySkew / 2)) {
+		t.Errorf("Expected the token to be treated as expired just before its expiry")
 	}
 }
 
-func TestHasAuthorizationCodeNoAuthCode(t *testing.T) {
-	values := map[string]string{
-		refreshTokenKey: "refreshToken",
+func TestTokenValid(t *testing.T) {
+	now := time.Now()
+	tokens := []*Token{
+		nil,
+		{AccessToken: "access"},
+		{Expiry: now.Add(time.Hour)},
 	}
-	if hasAuthorizationCode(values) {
-		t.Errorf("Expected false, got true")
+	for _, token := range tokens {
+		if token.validAt(now) {
+			t.Errorf("Expected %v not to be valid", token)
+		}
 	}
 }
 
-func TestHasAuthorizationCodeNoRefreshToken(t *testing.T) {
-	values := map[string]string{
-		authorizationCodeKey: "authCode",
+func TestTokenHasScope(t *testing.T) {
+	tests := []struct {
+		scope    string
+		expected bool
+	}{
+		{"", true},
+		{sdmScope, true},
+		{"openid " + sdmScope, true},
+		{"openid", false},
 	}
-	if hasAuthorizationCode(values) {
-		t.Errorf("Expected false, got true")
+	for _, test := range tests {
+		token := Token{Scope: test.scope}
+		if token.HasScope(sdmScope) != test.expected {
+			t.Errorf("Expected HasScope to be %v for %q", test.expected, test.scope)
+		}
 	}
 }
 
-func TestGetRedirectURL(t *testing.T) {
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Host = "example.com"
-	if getRedirectURL(r) != "http://example.com/code" {
-		t.Errorf("Expected http://example.com/code, got %s", getRedirectURL(r))
+func TestAuthorizeErrorMessage(t *testing.T) {
+	message := authorizeErrorMessage("redirect_uri_mismatch", "http://example.com/code")
+	if !strings.Contains(message, "http://example.com/code") {
+		t.Errorf("Expected the redirect URI to be explained, got %q", message)
+	}
+	if authorizeErrorMessage("unknown_error", "") == "" {
+		t.Errorf("Expected unknown errors to be explained")
 	}
 }
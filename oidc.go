@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+)
+
+// The state of a login with the OpenID Connect provider is held in the cookie
+// until the provider redirects back
+const (
+	oidcStateKey  = "oidcState"
+	oidcNonceKey  = "oidcNonce"
+	oidcNextKey   = "oidcNext"
+	oidcInviteKey = "oidcInvite"
+)
+
+var (
+	ErrOIDCState = errors.New("the login has expired, or was started in another browser")
+
+	oidcMu sync.Mutex
+	// oidcDiscovered is the provider's configuration, once it has been fetched
+	oidcDiscovered *oidcProvider
+)
+
+// oidcProvider holds the parts of the provider's discovery document used to
+// log in
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// discoverOIDC fetches the provider's configuration from OIDC_ISSUER
+func discoverOIDC() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcDiscovered != nil {
+		return oidcDiscovered, nil
+	}
+	resp, err := http.Get(strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OpenID Connect provider: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover OpenID Connect provider: %s", resp.Status)
+	}
+	provider := &oidcProvider{}
+	err = json.NewDecoder(resp.Body).Decode(provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenID Connect discovery document: %w", err)
+	}
+	if provider.Issuer != oidcIssuer {
+		return nil, fmt.Errorf("OpenID Connect provider issuer %q doesn't match OIDC_ISSUER", provider.Issuer)
+	}
+	oidcDiscovered = provider
+	return provider, nil
+}
+
+func getOIDCRedirectURL(r *http.Request) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/login/oidc/callback", scheme, r.Host)
+}
+
+// audience is the aud claim, which can be a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(b, &multiple)
+	*a = multiple
+	return err
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// idTokenClaims are the claims in an ID token used to log in
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// validate checks the ID token was issued by the provider for this login. The
+// signature isn't checked, as the token comes straight from the provider's
+// token endpoint over TLS, which OpenID Connect allows instead.
+func (c *idTokenClaims) validate(issuer, clientID, nonce string, now time.Time) error {
+	switch {
+	case c.Issuer != issuer:
+		return fmt.Errorf("ID token issued by %q, not %q", c.Issuer, issuer)
+	case !c.Audience.contains(clientID):
+		return errors.New("ID token was not issued to this app")
+	case now.After(time.Unix(c.Expiry, 0)):
+		return errors.New("ID token has expired")
+	case nonce == "" || c.Nonce != nonce:
+		return errors.New("ID token is not for this login")
+	case c.Subject == "":
+		return errors.New("ID token has no subject")
+	}
+	return nil
+}
+
+func (c *idTokenClaims) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.PreferredUsername != "" {
+		return c.PreferredUsername
+	}
+	return c.Subject
+}
+
+// parseIDToken returns the claims in an ID token
+func parseIDToken(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token: %w", err)
+	}
+	claims := &idTokenClaims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token: %w", err)
+	}
+	return claims, nil
+}
+
+// exchangeOIDCCode swaps the code the provider redirected back with for an ID
+// token
+func exchangeOIDCCode(provider *oidcProvider, code, redirectURL string) (*idTokenClaims, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		oauthErr := &oauthError{}
+		if json.Unmarshal(body, oauthErr) == nil && oauthErr.Code != "" {
+			return nil, oauthErr
+		}
+		return nil, fmt.Errorf("unexpected response: %s", body)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return parseIDToken(token.IDToken)
+}
+
+// oidcLogin sends the user to the provider to log in. If they're joining a
+// household, the invite is accepted once they're back.
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcIssuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverOIDC()
+	if err != nil {
+		log.Print(err.Error())
+		flash.SetFlashes(w, []flash.Flash{{
+			Level:   flash.ERROR,
+			Message: "Unable to reach the login provider. Please try again later",
+		}})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	data, err := getCookie(r)
+	if err != nil {
+		data = make(map[string]string)
+	}
+	r.ParseForm()
+	data[oidcStateKey] = newID()
+	data[oidcNonceKey] = newID()
+	data[oidcNextKey] = safeNext(r.FormValue("next"))
+	data[oidcInviteKey] = r.FormValue("invite")
+	err = setCookie(data, w)
+	if err != nil {
+		log.Printf("Failed to set cookie: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		log.Printf("Invalid authorization endpoint %q: %s", provider.AuthorizationEndpoint, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", oidcClientID)
+	query.Set("redirect_uri", getOIDCRedirectURL(r))
+	query.Set("scope", "openid profile")
+	query.Set("state", data[oidcStateKey])
+	query.Set("nonce", data[oidcNonceKey])
+	authURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authURL.String(), http.StatusSeeOther)
+}
+
+// oidcLoginUser returns the user to log in as with the ID token. Someone new
+// joins with their invite, or sets up the app if nobody has.
+func oidcLoginUser(claims *idTokenClaims, invite string) (*User, error) {
+	if user, ok := findUser(func(user *User) bool {
+		return user.OIDCSubject == claims.Subject
+	}); ok {
+		return user, nil
+	}
+	if invite != "" {
+		return acceptInvite(invite, User{OIDCSubject: claims.Subject}, "")
+	}
+	user, err := setupAdmin(User{Name: claims.displayName(), OIDCSubject: claims.Subject}, "")
+	if errors.Is(err, ErrAlreadySetUp) {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// oidcCallbackUser returns the user logging in with the code the provider
+// redirected back with
+func oidcCallbackUser(code, redirectURL, nonce, invite string) (*User, error) {
+	provider, err := discoverOIDC()
+	if err != nil {
+		return nil, err
+	}
+	claims, err := exchangeOIDCCode(provider, code, redirectURL)
+	if err != nil {
+		return nil, err
+	}
+	err = claims.validate(provider.Issuer, oidcClientID, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return oidcLoginUser(claims, invite)
+}
+
+// oidcCallback logs in with the code the provider redirected back with
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	data, err := getCookie(r)
+	if err != nil {
+		data = make(map[string]string)
+	}
+	state, nonce, next, invite := data[oidcStateKey], data[oidcNonceKey], data[oidcNextKey], data[oidcInviteKey]
+	delete(data, oidcStateKey)
+	delete(data, oidcNonceKey)
+	delete(data, oidcNextKey)
+	delete(data, oidcInviteKey)
+
+	fail := func(message string) {
+		setCookie(data, w)
+		flash.SetFlashes(w, []flash.Flash{{
+			Level:   flash.ERROR,
+			Message: message,
+		}})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+	query := r.URL.Query()
+	if state == "" || query.Get("state") != state {
+		log.Printf("Failed OpenID Connect login: %s", ErrOIDCState)
+		fail("Your login has expired. Please try again")
+		return
+	}
+	if errorCode := query.Get("error"); errorCode != "" {
+		log.Printf("OpenID Connect provider returned an error: %s: %s", errorCode, query.Get("error_description"))
+		fail("The login provider didn't log you in. Please try again")
+		return
+	}
+	user, err := oidcCallbackUser(query.Get("code"), getOIDCRedirectURL(r), nonce, invite)
+	if err == nil {
+		if err := signIn(w, data, user); err != nil {
+			log.Printf("Failed to set cookie: %s", err)
+		}
+		http.Redirect(w, r, safeNext(next), http.StatusSeeOther)
+		return
+	}
+	log.Printf("Failed OpenID Connect login: %s", err)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		fail("You haven't been invited yet. Please ask an admin of your household for a login link")
+	case errors.Is(err, ErrInviteNotFound):
+		fail("This login link has expired or has already been used. Please ask for a new one")
+	default:
+		fail("Unable to log in with the login provider. Please try again")
+	}
+}
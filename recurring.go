@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flash "github.com/andyfoston/nest-heating-boost/flash"
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+var (
+	ErrNoRecurringBoost = errors.New("no recurring boost found")
+
+	recurringTimersMu sync.Mutex
+	// recurringTimers holds the timer for the next run of each recurring boost
+	recurringTimers = make(map[string]*time.Timer)
+)
+
+// RecurringBoost is a boost which runs at the same time on given days of the
+// week, e.g. weekdays at 06:30.
+type RecurringBoost struct {
+	ID      string         `json:"id"`
+	Request BoostRequest   `json:"request"`
+	Days    []time.Weekday `json:"days"`
+	// Time of day to start the boost, in the format 15:04
+	Time        string `json:"time"`
+	Paused      bool   `json:"paused"`
+	SkipNext    bool   `json:"skipNext"`
+	HouseholdID string `json:"householdId"`
+}
+
+// RecurringBoostView is a recurring boost as shown on the recurring page
+type RecurringBoostView struct {
+	RecurringBoost
+	DisplayName string
+	Next        time.Time
+}
+
+// parseTimeOfDay parses a time in the format 15:04, returning the hours and minutes
+func parseTimeOfDay(value string) (int, int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parsed.Hour(), parsed.Minute(), nil
+}
+
+// Next returns the first time the boost should start after the given time, or
+// the zero time if the boost has no days to run on.
+func (b *RecurringBoost) Next(after time.Time) time.Time {
+	hour, minute, err := parseTimeOfDay(b.Time)
+	if err != nil || len(b.Days) == 0 {
+		return time.Time{}
+	}
+	// Check a week ahead, plus today in case the time hasn't passed yet
+	for i := 0; i <= 7; i++ {
+		day := after.AddDate(0, 0, i)
+		start := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, after.Location())
+		if start.After(after) && b.runsOn(start.Weekday()) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+func (b *RecurringBoost) runsOn(weekday time.Weekday) bool {
+	for _, day := range b.Days {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule describes when the boost runs, e.g. "Weekdays 06:30"
+func (b *RecurringBoost) Rule() string {
+	days := make([]time.Weekday, len(b.Days))
+	copy(days, b.Days)
+	sort.Slice(days, func(i, j int) bool { return days[i] < days[j] })
+
+	var description string
+	switch fmt.Sprint(days) {
+	case fmt.Sprint([]time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}):
+		description = "Every day"
+	case fmt.Sprint([]time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}):
+		description = "Weekdays"
+	case fmt.Sprint([]time.Weekday{time.Sunday, time.Saturday}):
+		description = "Weekends"
+	default:
+		names := make([]string, 0, len(days))
+		for _, day := range days {
+			names = append(names, day.String()[:3])
+		}
+		description = strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s %s", description, b.Time)
+}
+
+func addRecurringBoost(householdID string, recurring RecurringBoost) (*RecurringBoost, error) {
+	if _, _, err := parseTimeOfDay(recurring.Time); err != nil {
+		return nil, fmt.Errorf("invalid time %q: %w", recurring.Time, err)
+	}
+	if len(recurring.Days) == 0 {
+		return nil, errors.New("at least one day must be chosen")
+	}
+	recurring.ID = newID()
+	recurring.HouseholdID = householdID
+	err := store.PutRecurring(&recurring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save recurring boost: %w", err)
+	}
+	armRecurringBoost(recurring)
+	return &recurring, nil
+}
+
+// recurringInHousehold reports whether the recurring boost was added by the
+// household
+func recurringInHousehold(householdID, id string) bool {
+	for _, recurring := range store.RecurringBoosts() {
+		if recurring.ID == id {
+			return recurring.HouseholdID == householdID
+		}
+	}
+	return false
+}
+
+// deleteRecurringBoost removes one of the household's recurring boosts
+func deleteRecurringBoost(householdID, id string) error {
+	if !recurringInHousehold(householdID, id) {
+		return ErrNoRecurringBoost
+	}
+	recurringTimersMu.Lock()
+	if timer, ok := recurringTimers[id]; ok {
+		timer.Stop()
+		delete(recurringTimers, id)
+	}
+	recurringTimersMu.Unlock()
+	deleted, err := store.DeleteRecurring(id)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		return ErrNoRecurringBoost
+	}
+	return nil
+}
+
+// updateRecurringBoost changes one of the household's recurring boosts in the
+// store, returning the updated boost
+func updateRecurringBoost(householdID, id string, update func(recurring *RecurringBoost)) (*RecurringBoost, error) {
+	if !recurringInHousehold(householdID, id) {
+		return nil, ErrNoRecurringBoost
+	}
+	recurring, err := store.UpdateRecurring(id, update)
+	if err != nil {
+		return nil, err
+	}
+	if recurring == nil {
+		return nil, ErrNoRecurringBoost
+	}
+	return recurring, nil
+}
+
+// armRecurringBoost sets a timer for the next run of the boost
+func armRecurringBoost(recurring RecurringBoost) {
+	next := recurring.Next(time.Now())
+	if next.IsZero() {
+		return
+	}
+	recurringTimersMu.Lock()
+	defer recurringTimersMu.Unlock()
+	if timer, ok := recurringTimers[recurring.ID]; ok {
+		timer.Stop()
+	}
+	recurringTimers[recurring.ID] = time.AfterFunc(time.Until(next), func() {
+		runRecurringBoost(recurring.ID)
+	})
+}
+
+func runRecurringBoost(id string) {
+	// Re-read the boost, as it may have been paused or skipped since it was armed
+	var recurring RecurringBoost
+	var run bool
+	updated, err := store.UpdateRecurring(id, func(r *RecurringBoost) {
+		run = !r.Paused && !r.SkipNext
+		// Skipping only applies to a single run
+		r.SkipNext = false
+		recurring = *r
+	})
+	if err != nil {
+		log.Printf("Failed to update recurring boost %s: %s", id, err)
+	}
+	if updated == nil {
+		// Deleted since it was armed
+		return
+	}
+	defer armRecurringBoost(recurring)
+	if !run {
+		log.Printf("Skipping recurring boost %s on %s", id, recurring.Request.DeviceID)
+		return
+	}
+	log.Printf("Starting recurring boost %s on %s", id, recurring.Request.DeviceID)
+	err = startBackgroundBoost(recurring.HouseholdID, recurring.Request)
+	if err != nil {
+		log.Printf("Failed to start recurring boost %s: %s", id, err)
+	}
+}
+
+func resumeRecurringBoosts() {
+	for _, recurring := range store.RecurringBoosts() {
+		armRecurringBoost(recurring)
+	}
+}
+
+// getRecurringBoostViews returns the household's recurring boosts, running
+// soonest first
+func getRecurringBoostViews(householdID string, devices []nest.Device) []RecurringBoostView {
+	names := deviceNames(devices)
+	now := time.Now()
+	views := make([]RecurringBoostView, 0)
+	for _, recurring := range store.RecurringBoosts() {
+		if recurring.HouseholdID != householdID {
+			continue
+		}
+		views = append(views, RecurringBoostView{
+			RecurringBoost: recurring,
+			DisplayName:    names.get(recurring.Request.DeviceID),
+			Next:           recurring.Next(now),
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Next.Before(views[j].Next)
+	})
+	return views
+}
+
+// parseRecurringForm reads a new recurring boost from the form on the recurring page
+func parseRecurringForm(r *http.Request) (RecurringBoost, error) {
+	recurring := RecurringBoost{Time: r.FormValue("time")}
+	recurring.Request.DeviceID = r.FormValue("device")
+	if recurring.Request.DeviceID == "" {
+		return recurring, errors.New("unable to find the thermostat to adjust")
+	}
+	temperature, err := strconv.ParseFloat(r.FormValue("temperature"), 32)
+	if err != nil {
+		return recurring, fmt.Errorf("unable to get the temperature to set to: %w", err)
+	}
+	recurring.Request.Temperature = float32(temperature)
+	duration, err := strconv.ParseInt(r.FormValue("duration"), 10, 16)
+	if err != nil {
+		return recurring, fmt.Errorf("unable to get the duration to run the heating for: %w", err)
+	}
+	recurring.Request.Duration = int(duration)
+	for _, value := range r.Form["day"] {
+		day, err := strconv.Atoi(value)
+		if err != nil || day < int(time.Sunday) || day > int(time.Saturday) {
+			return recurring, fmt.Errorf("invalid day: %s", value)
+		}
+		recurring.Days = append(recurring.Days, time.Weekday(day))
+	}
+	recurring.Request.Replace = r.FormValue("replace") == "on"
+	recurring.Request.SwitchMode = r.FormValue("switch") == "on"
+	recurring.Request.RequestedBy = r.RemoteAddr
+	return recurring, nil
+}
+
+func recurringPage(w http.ResponseWriter, r *http.Request) {
+	data, err := getCookie(r)
+	if err != nil {
+		log.Printf("Unable to get cookie: %s\n", err.Error())
+	}
+	householdID, ok := authorizedHouseholdFromCookie(w, data)
+	if !ok {
+		log.Println("Household has no access to Nest. Redirecting to /authorize")
+		if vault.Revoked(householdID) {
+			flash.SetFlashes(w, []flash.Flash{tokenErrorFlash(ErrInvalidGrant)})
+		}
+		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+		return
+	}
+	token, err := accessTokens.Token(householdID)
+	if err != nil {
+		log.Printf("Failed to get token for household: %s\n", err)
+		flash.SetFlashes(w, []flash.Flash{tokenErrorFlash(err)})
+		http.Redirect(w, r, "/authorize", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		if !checkCSRF(w, r) {
+			http.Redirect(w, r, "/recurring", http.StatusSeeOther)
+			return
+		}
+		flashes := make([]flash.Flash, 0, 1)
+		recurring, err := parseRecurringForm(r)
+		if user, ok := userFromCookie(w, data); ok {
+			recurring.Request.RequestedBy = requestedBy(r, user)
+		}
+		if err == nil {
+			_, err = addRecurringBoost(householdID, recurring)
+		}
+		if err != nil {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.ERROR,
+				Message: fmt.Sprintf("Failed to add recurring boost: %s", err),
+			})
+		} else {
+			flashes = append(flashes, flash.Flash{
+				Level:   flash.INFO,
+				Message: "Recurring boost added",
+			})
+		}
+		flash.SetFlashes(w, flashes)
+		http.Redirect(w, r, "/recurring", http.StatusSeeOther)
+		return
+	}
+
+	files := []string{
+		"./templates/base.tmpl",
+		"./templates/recurring.tmpl",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		log.Printf("Unable to parse files: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	flashes, err := flash.GetFlashes(w, r)
+	if err != nil {
+		log.Printf("Failed to get flashes: %s\n", err)
+	}
+	devices, _, err := devicesCache.Devices(householdID, *token)
+	if err != nil {
+		log.Printf("Unable to get a list of devices: %s\n", err)
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.WARN,
+			Message: "Unable to get a list of thermostats. Please try again in a couple of minutes.",
+		})
+		devices = &nest.Devices{}
+	}
+	days := make([]time.Weekday, 0, 7)
+	for day := time.Monday; day <= time.Saturday; day++ {
+		days = append(days, day)
+	}
+	days = append(days, time.Sunday)
+	err = ts.ExecuteTemplate(w, "base", map[string]interface{}{
+		"Flashes":   flashes,
+		"Devices":   devices.Devices,
+		"Days":      days,
+		"Recurring": getRecurringBoostViews(householdID, devices.Devices),
+		"CSRF":      csrfToken(w, data),
+	})
+	if err != nil {
+		log.Printf("Failed to execute template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// recurringAction handles the buttons shown against each recurring boost
+func recurringAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	defer http.Redirect(w, r, "/recurring", http.StatusSeeOther)
+	if !checkCSRF(w, r) {
+		return
+	}
+	householdID, ok := householdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	id := r.FormValue("id")
+	var message string
+	var err error
+	switch r.URL.Path {
+	case "/recurring/delete":
+		err = deleteRecurringBoost(householdID, id)
+		message = "Recurring boost deleted"
+	case "/recurring/pause":
+		var recurring *RecurringBoost
+		recurring, err = updateRecurringBoost(householdID, id, func(recurring *RecurringBoost) {
+			recurring.Paused = !recurring.Paused
+		})
+		if err == nil && recurring.Paused {
+			message = "Recurring boost paused"
+		} else {
+			message = "Recurring boost resumed"
+		}
+	case "/recurring/skip":
+		var recurring *RecurringBoost
+		recurring, err = updateRecurringBoost(householdID, id, func(recurring *RecurringBoost) {
+			recurring.SkipNext = !recurring.SkipNext
+		})
+		if err == nil && recurring.SkipNext {
+			message = "The next run of the recurring boost will be skipped"
+		} else {
+			message = "The next run of the recurring boost will no longer be skipped"
+		}
+	}
+	flashes := make([]flash.Flash, 0, 1)
+	if err != nil {
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.WARN,
+			Message: fmt.Sprintf("Unable to update recurring boost: %s", err),
+		})
+	} else {
+		flashes = append(flashes, flash.Flash{
+			Level:   flash.INFO,
+			Message: message,
+		})
+	}
+	err = flash.SetFlashes(w, flashes)
+	if err != nil {
+		log.Printf("Failed to set flash: %s\n", err)
+	}
+}
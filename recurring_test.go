@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+func TestRecurringBoostNext(t *testing.T) {
+	recurring := RecurringBoost{Days: weekdays, Time: "06:30"}
+	// Friday 10th May 2024
+	friday := time.Date(2024, 5, 10, 6, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		after    time.Time
+		expected time.Time
+	}{
+		{friday, time.Date(2024, 5, 10, 6, 30, 0, 0, time.Local)},
+		{friday.Add(time.Hour), time.Date(2024, 5, 13, 6, 30, 0, 0, time.Local)},
+		{time.Date(2024, 5, 10, 6, 30, 0, 0, time.Local), time.Date(2024, 5, 13, 6, 30, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		next := recurring.Next(test.after)
+		if !next.Equal(test.expected) {
+			t.Errorf("Expected %s after %s, got %s", test.expected, test.after, next)
+		}
+	}
+}
+
+func TestRecurringBoostNextNoDays(t *testing.T) {
+	recurring := RecurringBoost{Time: "06:30"}
+	if !recurring.Next(time.Now()).IsZero() {
+		t.Errorf("Expected no next run")
+	}
+}
+
+func TestRecurringBoostRule(t *testing.T) {
+	tests := []struct {
+		days     []time.Weekday
+		expected string
+	}{
+		{weekdays, "Weekdays 06:30"},
+		{[]time.Weekday{time.Saturday, time.Sunday}, "Weekends 06:30"},
+		{[]time.Weekday{time.Saturday}, "Sat 06:30"},
+		{[]time.Weekday{time.Wednesday, time.Monday}, "Mon, Wed 06:30"},
+	}
+	for _, test := range tests {
+		recurring := RecurringBoost{Days: test.days, Time: "06:30"}
+		if recurring.Rule() != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, recurring.Rule())
+		}
+	}
+}
+
+func TestParseRecurringForm(t *testing.T) {
+	form := url.Values{
+		"device":      {"device"},
+		"temperature": {"21"},
+		"duration":    {"45"},
+		"time":        {"06:30"},
+		"day":         {"1", "3"},
+	}
+	r := httptest.NewRequest("POST", "/recurring", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	recurring, err := parseRecurringForm(r)
+	if err != nil {
+		t.Fatalf("Failed to parse form: %s", err)
+	}
+	if recurring.Request.Temperature != 21 || recurring.Request.Duration != 45 {
+		t.Errorf("Unexpected request: %v", recurring.Request)
+	}
+	if len(recurring.Days) != 2 || recurring.Days[0] != time.Monday || recurring.Days[1] != time.Wednesday {
+		t.Errorf("Unexpected days: %v", recurring.Days)
+	}
+}
+
+func TestRunRecurringBoostSkipNext(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	store.PutRecurring(&RecurringBoost{ID: "abc", Days: weekdays, Time: "06:30", SkipNext: true, HouseholdID: "household"})
+	defer deleteRecurringBoost("household", "abc")
+
+	runRecurringBoost("abc")
+	recurring := store.RecurringBoosts()[0]
+	if recurring.SkipNext {
+		t.Errorf("Expected skip to only apply to a single run")
+	}
+	if len(store.History(HistoryFilter{})) != 0 {
+		t.Errorf("Expected the boost not to run")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+var (
+	ErrNoScheduledBoost = errors.New("no scheduled boost found")
+
+	scheduledTimersMu sync.Mutex
+	// scheduledTimers holds the timers for boosts due to start, keyed by ID
+	scheduledTimers = make(map[string]*time.Timer)
+)
+
+// ScheduledBoost is a boost which has been requested to start at a later time
+type ScheduledBoost struct {
+	ID          string       `json:"id"`
+	Request     BoostRequest `json:"request"`
+	StartAt     time.Time    `json:"startAt"`
+	HouseholdID string       `json:"householdId"`
+}
+
+// ScheduledBoostView is a scheduled boost as shown on the home page
+type ScheduledBoostView struct {
+	ScheduledBoost
+	DisplayName string
+}
+
+// scheduleBoost records a boost to start at the given time
+func scheduleBoost(householdID string, request BoostRequest, startAt time.Time) (*ScheduledBoost, error) {
+	scheduled := ScheduledBoost{
+		ID:          newID(),
+		Request:     request,
+		StartAt:     startAt,
+		HouseholdID: householdID,
+	}
+	err := store.PutScheduled(&scheduled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save scheduled boost: %w", err)
+	}
+	armScheduledBoost(scheduled)
+	return &scheduled, nil
+}
+
+func armScheduledBoost(scheduled ScheduledBoost) {
+	scheduledTimersMu.Lock()
+	defer scheduledTimersMu.Unlock()
+	scheduledTimers[scheduled.ID] = time.AfterFunc(time.Until(scheduled.StartAt), func() {
+		runScheduledBoost(scheduled)
+	})
+}
+
+// cancelScheduledBoost removes a household's scheduled boost before it has
+// started
+func cancelScheduledBoost(householdID, id string) (*ScheduledBoost, error) {
+	if !scheduledInHousehold(householdID, id) {
+		return nil, ErrNoScheduledBoost
+	}
+	scheduledTimersMu.Lock()
+	defer scheduledTimersMu.Unlock()
+	timer, ok := scheduledTimers[id]
+	if !ok || !timer.Stop() {
+		return nil, ErrNoScheduledBoost
+	}
+	delete(scheduledTimers, id)
+	scheduled, err := store.DeleteScheduled(id)
+	if err != nil {
+		log.Printf("Failed to remove scheduled boost %s: %s", id, err)
+	}
+	return scheduled, nil
+}
+
+// scheduledInHousehold reports whether the scheduled boost was added by the
+// household
+func scheduledInHousehold(householdID, id string) bool {
+	for _, scheduled := range store.ScheduledBoosts() {
+		if scheduled.ID == id {
+			return scheduled.HouseholdID == householdID
+		}
+	}
+	return false
+}
+
+func runScheduledBoost(scheduled ScheduledBoost) {
+	scheduledTimersMu.Lock()
+	delete(scheduledTimers, scheduled.ID)
+	scheduledTimersMu.Unlock()
+	_, err := store.DeleteScheduled(scheduled.ID)
+	if err != nil {
+		log.Printf("Failed to remove scheduled boost %s: %s", scheduled.ID, err)
+	}
+
+	request := scheduled.Request
+	// Boosts missed while the server was down only run for the time remaining
+	request.Duration -= int(time.Since(scheduled.StartAt).Minutes())
+	if request.Duration < 1 {
+		request.Duration = 1
+	}
+	log.Printf("Starting scheduled boost %s on %s", scheduled.ID, request.DeviceID)
+	err = startBackgroundBoost(scheduled.HouseholdID, request)
+	if err != nil {
+		log.Printf("Failed to start scheduled boost %s: %s", scheduled.ID, err)
+	}
+}
+
+// startBackgroundBoost starts a boost without a user being present, such as
+// from a schedule. A failure to get a token, or a boost already running on the
+// device, is recorded in the history, as startBoost does for other failures.
+func startBackgroundBoost(householdID string, request BoostRequest) error {
+	token, err := accessTokens.Token(householdID)
+	if err != nil {
+		err = fmt.Errorf("failed to get token: %w", err)
+		recordFailedBoost(householdID, request, err)
+		return err
+	}
+	_, err = startBoost(householdID, *token, request)
+	if errors.Is(err, ErrBoostInProgress) {
+		recordFailedBoost(householdID, request, err)
+	}
+	return err
+}
+
+// recordFailedBoost adds a boost which couldn't be started to the history
+func recordFailedBoost(householdID string, request BoostRequest, err error) {
+	historyErr := store.AddHistory(HistoryEntry{
+		ID:                   newID(),
+		HouseholdID:          householdID,
+		DeviceID:             request.DeviceID,
+		RequestedBy:          request.RequestedBy,
+		RequestedTemperature: request.Temperature,
+		Duration:             request.Duration,
+		Start:                time.Now(),
+		End:                  time.Now(),
+		Outcome:              OutcomeFailed,
+		Error:                err.Error(),
+	})
+	if historyErr != nil {
+		log.Printf("Failed to add history for boost on %s: %s", request.DeviceID, historyErr)
+	}
+}
+
+// resumeScheduledBoosts re-arms boosts scheduled before the server restarted.
+// Boosts which would already have finished are dropped.
+func resumeScheduledBoosts() {
+	for _, scheduled := range store.ScheduledBoosts() {
+		end := scheduled.StartAt.Add(time.Minute * time.Duration(scheduled.Request.Duration))
+		if time.Now().After(end) {
+			log.Printf("Scheduled boost %s on %s was missed while the server was down", scheduled.ID, scheduled.Request.DeviceID)
+			_, err := store.DeleteScheduled(scheduled.ID)
+			if err != nil {
+				log.Printf("Failed to remove scheduled boost %s: %s", scheduled.ID, err)
+			}
+			continue
+		}
+		armScheduledBoost(scheduled)
+	}
+}
+
+// getScheduledBoostViews returns the household's boosts waiting to start,
+// soonest first
+func getScheduledBoostViews(householdID string, devices []nest.Device) []ScheduledBoostView {
+	names := deviceNames(devices)
+	scheduled := store.ScheduledBoosts()
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].StartAt.Before(scheduled[j].StartAt)
+	})
+	views := make([]ScheduledBoostView, 0, len(scheduled))
+	for _, boost := range scheduled {
+		if boost.HouseholdID != householdID {
+			continue
+		}
+		views = append(views, ScheduledBoostView{ScheduledBoost: boost, DisplayName: names.get(boost.Request.DeviceID)})
+	}
+	return views
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleBoost(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	request := BoostRequest{DeviceID: "device", Temperature: 21, Duration: 30}
+	scheduled, err := scheduleBoost("household", request, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to schedule boost: %s", err)
+	}
+	if views := getScheduledBoostViews("other-household", nil); len(views) != 0 {
+		t.Errorf("Expected other households not to see the scheduled boost, got %v", views)
+	}
+	if _, err := cancelScheduledBoost("other-household", scheduled.ID); err != ErrNoScheduledBoost {
+		t.Errorf("Expected other households not to be able to cancel the scheduled boost, got %v", err)
+	}
+	views := getScheduledBoostViews("household", nil)
+	if len(views) != 1 || views[0].ID != scheduled.ID {
+		t.Fatalf("Expected the scheduled boost to be listed, got %v", views)
+	}
+	if views[0].DisplayName != "device" {
+		t.Errorf("Expected the device ID as a fallback, got %s", views[0].DisplayName)
+	}
+
+	_, err = cancelScheduledBoost("household", scheduled.ID)
+	if err != nil {
+		t.Fatalf("Failed to cancel scheduled boost: %s", err)
+	}
+	if len(store.ScheduledBoosts()) != 0 {
+		t.Errorf("Expected the scheduled boost to be removed")
+	}
+	_, err = cancelScheduledBoost("household", scheduled.ID)
+	if err != ErrNoScheduledBoost {
+		t.Errorf("Expected ErrNoScheduledBoost, got %v", err)
+	}
+}
+
+func TestResumeScheduledBoostsDropsMissed(t *testing.T) {
+	store, _ = OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	store.PutScheduled(&ScheduledBoost{
+		ID:      "missed",
+		Request: BoostRequest{DeviceID: "device", Duration: 30},
+		StartAt: time.Now().Add(-time.Hour),
+	})
+	store.PutScheduled(&ScheduledBoost{
+		ID:          "future",
+		Request:     BoostRequest{DeviceID: "device", Duration: 30},
+		StartAt:     time.Now().Add(time.Hour),
+		HouseholdID: "household",
+	})
+	resumeScheduledBoosts()
+	defer cancelScheduledBoost("household", "future")
+
+	scheduled := store.ScheduledBoosts()
+	if len(scheduled) != 1 || scheduled[0].ID != "future" {
+		t.Errorf("Expected only the future boost to be kept, got %v", scheduled)
+	}
+}
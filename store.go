@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type storeData struct {
+	Boosts    map[string]*BoostJob       `json:"boosts"`
+	History   []HistoryEntry             `json:"history"`
+	Scheduled map[string]*ScheduledBoost `json:"scheduled"`
+	Recurring map[string]*RecurringBoost `json:"recurring"`
+	// Secrets are the encrypted refresh tokens in the vault, keyed by household
+	Secrets map[string]string `json:"secrets"`
+	// Revoked holds when Google rejected a household's refresh token, until
+	// it's replaced, so the household can be told why access was lost
+	Revoked map[string]time.Time `json:"revoked"`
+	Users   map[string]*User     `json:"users"`
+	Invites map[string]*Invite   `json:"invites"`
+}
+
+// Store is a small JSON file backed store, used to keep track of state that
+// needs to survive a restart of the server.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	data storeData
+}
+
+func OpenStore(path string) (*Store, error) {
+	store := &Store{path: path}
+	body, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &store.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if store.data.Boosts == nil {
+		store.data.Boosts = make(map[string]*BoostJob)
+	}
+	if store.data.Scheduled == nil {
+		store.data.Scheduled = make(map[string]*ScheduledBoost)
+	}
+	if store.data.Recurring == nil {
+		store.data.Recurring = make(map[string]*RecurringBoost)
+	}
+	if store.data.Secrets == nil {
+		store.data.Secrets = make(map[string]string)
+	}
+	if store.data.Revoked == nil {
+		store.data.Revoked = make(map[string]time.Time)
+	}
+	if store.data.Users == nil {
+		store.data.Users = make(map[string]*User)
+	}
+	if store.data.Invites == nil {
+		store.data.Invites = make(map[string]*Invite)
+	}
+	return store, nil
+}
+
+// save writes the store to disk. The caller must hold s.mu.
+func (s *Store) save() error {
+	body, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash mid-write doesn't lose the store
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, body, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Store) PutBoost(job *BoostJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *job
+	s.data.Boosts[job.ID] = &copied
+	return s.save()
+}
+
+func (s *Store) DeleteBoost(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Boosts, id)
+	return s.save()
+}
+
+func (s *Store) Boosts() []BoostJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]BoostJob, 0, len(s.data.Boosts))
+	for _, job := range s.data.Boosts {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (s *Store) PutScheduled(scheduled *ScheduledBoost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *scheduled
+	s.data.Scheduled[scheduled.ID] = &copied
+	return s.save()
+}
+
+// DeleteScheduled removes a scheduled boost, returning it if it was found
+func (s *Store) DeleteScheduled(id string) (*ScheduledBoost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scheduled := s.data.Scheduled[id]
+	delete(s.data.Scheduled, id)
+	return scheduled, s.save()
+}
+
+func (s *Store) ScheduledBoosts() []ScheduledBoost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scheduled := make([]ScheduledBoost, 0, len(s.data.Scheduled))
+	for _, boost := range s.data.Scheduled {
+		scheduled = append(scheduled, *boost)
+	}
+	return scheduled
+}
+
+func (s *Store) PutRecurring(recurring *RecurringBoost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *recurring
+	s.data.Recurring[recurring.ID] = &copied
+	return s.save()
+}
+
+// UpdateRecurring changes a recurring boost, returning the updated boost or nil
+// if it was not found
+func (s *Store) UpdateRecurring(id string, update func(recurring *RecurringBoost)) (*RecurringBoost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recurring, ok := s.data.Recurring[id]
+	if !ok {
+		return nil, nil
+	}
+	update(recurring)
+	copied := *recurring
+	return &copied, s.save()
+}
+
+// DeleteRecurring removes a recurring boost, returning it if it was found
+func (s *Store) DeleteRecurring(id string) (*RecurringBoost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recurring := s.data.Recurring[id]
+	delete(s.data.Recurring, id)
+	return recurring, s.save()
+}
+
+func (s *Store) RecurringBoosts() []RecurringBoost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recurring := make([]RecurringBoost, 0, len(s.data.Recurring))
+	for _, boost := range s.data.Recurring {
+		recurring = append(recurring, *boost)
+	}
+	return recurring
+}
+
+func (s *Store) PutSecret(id string, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Secrets[id] = secret
+	delete(s.data.Revoked, id)
+	return s.save()
+}
+
+// Secret returns a secret, or false if it was not found
+func (s *Store) Secret(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.data.Secrets[id]
+	return secret, ok
+}
+
+func (s *Store) DeleteSecret(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Secrets, id)
+	return s.save()
+}
+
+// RevokeSecret removes a secret, recording that it was revoked until another
+// secret is put with the same ID
+func (s *Store) RevokeSecret(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Secrets, id)
+	s.data.Revoked[id] = time.Now()
+	return s.save()
+}
+
+// Revoked reports whether the secret was revoked and hasn't been put since
+func (s *Store) Revoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data.Revoked[id]
+	return ok
+}
+
+// Secrets returns a copy of all the secrets, keyed by ID
+func (s *Store) Secrets() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets := make(map[string]string, len(s.data.Secrets))
+	for id, secret := range s.data.Secrets {
+		secrets[id] = secret
+	}
+	return secrets
+}
+
+func (s *Store) PutUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *user
+	s.data.Users[user.ID] = &copied
+	return s.save()
+}
+
+// User returns a user, or false if it was not found
+func (s *Store) User(id string) (*User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.data.Users[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *user
+	return &copied, true
+}
+
+// DeleteUser removes a user, returning it if it was found
+func (s *Store) DeleteUser(id string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.data.Users[id]
+	delete(s.data.Users, id)
+	return user, s.save()
+}
+
+func (s *Store) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0, len(s.data.Users))
+	for _, user := range s.data.Users {
+		users = append(users, *user)
+	}
+	return users
+}
+
+func (s *Store) PutInvite(invite *Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *invite
+	s.data.Invites[invite.ID] = &copied
+	return s.save()
+}
+
+// DeleteInvite removes an invite, returning it if it was found
+func (s *Store) DeleteInvite(id string) (*Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite := s.data.Invites[id]
+	delete(s.data.Invites, id)
+	return invite, s.save()
+}
+
+func (s *Store) Invites() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites := make([]Invite, 0, len(s.data.Invites))
+	for _, invite := range s.data.Invites {
+		invites = append(invites, *invite)
+	}
+	return invites
+}
+
+func (s *Store) AddHistory(entry HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.History = append(s.data.History, entry)
+	if len(s.data.History) > maxHistory {
+		s.data.History = s.data.History[len(s.data.History)-maxHistory:]
+	}
+	return s.save()
+}
+
+func (s *Store) UpdateHistory(id string, update func(entry *HistoryEntry)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.History {
+		if s.data.History[i].ID == id {
+			update(&s.data.History[i])
+			return s.save()
+		}
+	}
+	return fmt.Errorf("no history for boost %s", id)
+}
+
+// History returns the entries matching the filter, newest first
+func (s *Store) History(filter HistoryFilter) []HistoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]HistoryEntry, 0)
+	for i := len(s.data.History) - 1; i >= 0; i-- {
+		if filter.Matches(&s.data.History[i]) {
+			entries = append(entries, s.data.History[i])
+		}
+	}
+	return entries
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andyfoston/nest-heating-boost/nest"
+)
+
+func TestStorePutBoost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	job := BoostJob{
+		ID:          "abc",
+		DeviceID:    "device",
+		Original:    nest.Setpoint{Mode: nest.ThermostatModeHeat, HeatCelsius: 18},
+		Temperature: 21,
+		Start:       time.Now(),
+		End:         time.Now().Add(time.Hour),
+	}
+	err = s.PutBoost(&job)
+	if err != nil {
+		t.Fatalf("Failed to save boost: %s", err)
+	}
+
+	// Re-open the store to check the boost was persisted
+	s, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to re-open store: %s", err)
+	}
+	boosts := s.Boosts()
+	if len(boosts) != 1 {
+		t.Fatalf("Expected 1 boost, got %d", len(boosts))
+	}
+	if boosts[0].DeviceID != "device" || boosts[0].Original.HeatCelsius != 18 {
+		t.Errorf("Unexpected boost: %v", boosts[0])
+	}
+}
+
+func TestStoreDeleteBoost(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	s.PutBoost(&BoostJob{ID: "abc"})
+	err = s.DeleteBoost("abc")
+	if err != nil {
+		t.Fatalf("Failed to delete boost: %s", err)
+	}
+	if len(s.Boosts()) != 0 {
+		t.Errorf("Expected no boosts")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// tokenRefresh is a refresh of an access token in progress, which other
+// requests for the same token wait for rather than refreshing it again
+type tokenRefresh struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// TokenSource supplies a valid access token, refreshing it when needed
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+// tokenManager caches access tokens by household, so that page loads and boosts
+// reuse an access token until shortly before it expires instead of asking
+// Google for a new one every time.
+type tokenManager struct {
+	mu       sync.Mutex
+	tokens   map[string]Token
+	inflight map[string]*tokenRefresh
+	refresh  func(householdID string) (*Token, error)
+	// revoked is called when Google rejects the refresh token for a household,
+	// before the requests waiting for it are told
+	revoked func(householdID string)
+	now     func() time.Time
+}
+
+func newTokenManager(refresh func(householdID string) (*Token, error), revoked func(householdID string)) *tokenManager {
+	return &tokenManager{
+		tokens:   make(map[string]Token),
+		inflight: make(map[string]*tokenRefresh),
+		refresh:  refresh,
+		revoked:  revoked,
+		now:      time.Now,
+	}
+}
+
+// Token returns an access token for the household, refreshing it if there isn't
+// a cached one which is still valid
+func (m *tokenManager) Token(householdID string) (*Token, error) {
+	m.mu.Lock()
+	if token, ok := m.tokens[householdID]; ok && token.validAt(m.now()) {
+		m.mu.Unlock()
+		return &token, nil
+	}
+	refresh, ok := m.inflight[householdID]
+	if !ok {
+		refresh = &tokenRefresh{done: make(chan struct{})}
+		m.inflight[householdID] = refresh
+		go m.doRefresh(householdID, refresh)
+	}
+	m.mu.Unlock()
+
+	<-refresh.done
+	if refresh.err != nil {
+		return nil, refresh.err
+	}
+	token := *refresh.token
+	return &token, nil
+}
+
+func (m *tokenManager) doRefresh(householdID string, refresh *tokenRefresh) {
+	refresh.token, refresh.err = m.refresh(householdID)
+	if errors.Is(refresh.err, ErrInvalidGrant) && m.revoked != nil {
+		m.revoked(householdID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.inflight, householdID)
+	if refresh.err == nil {
+		for id, token := range m.tokens {
+			if !token.validAt(m.now()) {
+				delete(m.tokens, id)
+			}
+		}
+		m.tokens[householdID] = *refresh.token
+	}
+	close(refresh.done)
+}
+
+// Forget drops the cached access token, e.g. because Google rejected it
+func (m *tokenManager) Forget(householdID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, householdID)
+}
+
+type householdTokenSource struct {
+	manager     *tokenManager
+	householdID string
+}
+
+func (s householdTokenSource) Token() (*Token, error) {
+	return s.manager.Token(s.householdID)
+}
+
+// Source returns a TokenSource for the household, for work such as boosts which
+// carry on after the request that started them
+func (m *tokenManager) Source(householdID string) TokenSource {
+	return householdTokenSource{manager: m, householdID: householdID}
+}
+
+// refreshHousehold gets a new access token using the household's refresh token
+// from the vault
+func refreshHousehold(householdID string) (*Token, error) {
+	refreshToken, err := vault.RefreshToken(householdID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := GetTokenFromRefreshToken(refreshToken)
+	if errors.Is(err, ErrInvalidGrant) {
+		// An admin may have authorized access again while the old refresh
+		// token was in use, which shouldn't revoke the new one
+		if current, currentErr := vault.RefreshToken(householdID); currentErr == nil && current != refreshToken {
+			return GetTokenFromRefreshToken(current)
+		}
+	}
+	return token, err
+}
+
+// revokeHousehold stops everything relying on a household whose refresh token
+// Google has rejected, and removes the token from the vault. Scheduled boosts
+// are removed, recurring boosts are paused and running boosts are stopped, and
+// all are recorded as failed in the history with the reason.
+func revokeHousehold(householdID string) {
+	log.Printf("Refresh token for a household has been revoked. Stopping the boosts using it")
+	if err := vault.Revoke(householdID); err != nil {
+		log.Printf("Failed to remove revoked refresh token: %s", err)
+	}
+	devicesCache.Refresh(householdID)
+	for _, scheduled := range store.ScheduledBoosts() {
+		if scheduled.HouseholdID != householdID {
+			continue
+		}
+		if _, err := cancelScheduledBoost(householdID, scheduled.ID); err != nil {
+			// It has already started
+			continue
+		}
+		recordFailedBoost(householdID, scheduled.Request, fmt.Errorf("scheduled boost for %s was not started: %w", scheduled.StartAt.Format("Mon 15:04"), ErrInvalidGrant))
+	}
+	for _, recurring := range store.RecurringBoosts() {
+		if recurring.HouseholdID != householdID || recurring.Paused {
+			continue
+		}
+		if _, err := updateRecurringBoost(householdID, recurring.ID, func(r *RecurringBoost) { r.Paused = true }); err != nil {
+			log.Printf("Failed to pause recurring boost %s: %s", recurring.ID, err)
+			continue
+		}
+		recordFailedBoost(householdID, recurring.Request, fmt.Errorf("recurring boost for %s was paused: %w", recurring.Rule(), ErrInvalidGrant))
+	}
+	abandonBoosts(householdID, ErrInvalidGrant)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRefresh returns a refresh function for a tokenManager which hands
+// out numbered access tokens, and the number of refreshes so far
+func countingRefresh(now *time.Time) (func(string) (*Token, error), func() int) {
+	var mu sync.Mutex
+	refreshes := 0
+	refresh := func(refreshToken string) (*Token, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshes++
+		return &Token{
+			AccessToken:  fmt.Sprintf("access-%d", refreshes),
+			ExpiresIn:    3600,
+			RefreshToken: refreshToken,
+			Expiry:       now.Add(time.Hour),
+		}, nil
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return refreshes
+	}
+	return refresh, count
+}
+
+func TestTokenManagerCaches(t *testing.T) {
+	now := time.Now()
+	refresh, count := countingRefresh(&now)
+	manager := newTokenManager(refresh, nil)
+	manager.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		token, err := manager.Token("refresh-token")
+		if err != nil || token.AccessToken != "access-1" {
+			t.Fatalf("Expected access-1, got %v %v", token, err)
+		}
+	}
+	if count() != 1 {
+		t.Errorf("Expected a single refresh, got %d", count())
+	}
+
+	// Refreshed shortly before it expires
+	now = now.Add(time.Hour - 30*time.Second)
+	token, _ := manager.Token("refresh-token")
+	if token.AccessToken != "access-2" {
+		t.Errorf("Expected the token to be refreshed before expiry, got %s", token.AccessToken)
+	}
+
+	manager.Forget("refresh-token")
+	token, _ = manager.Token("refresh-token")
+	if token.AccessToken != "access-3" {
+		t.Errorf("Expected the token to be refreshed after forgetting it, got %s", token.AccessToken)
+	}
+}
+
+func TestTokenManagerDeduplicatesRefreshes(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	refreshes := 0
+	manager := newTokenManager(func(refreshToken string) (*Token, error) {
+		mu.Lock()
+		refreshes++
+		mu.Unlock()
+		<-release
+		return &Token{AccessToken: "access", ExpiresIn: 3600, Expiry: time.Now().Add(time.Hour)}, nil
+	}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := manager.Token("refresh-token")
+			if err != nil || token.AccessToken != "access" {
+				t.Errorf("Expected the shared token, got %v %v", token, err)
+			}
+		}()
+	}
+	// Give the goroutines a chance to wait on the refresh
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if refreshes != 1 {
+		t.Errorf("Expected a single refresh, got %d", refreshes)
+	}
+}
+
+func TestTokenManagerDoesNotCacheErrors(t *testing.T) {
+	calls := 0
+	manager := newTokenManager(func(refreshToken string) (*Token, error) {
+		calls++
+		return nil, errors.New("invalid_grant")
+	}, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := manager.Token("refresh-token"); err == nil {
+			t.Fatalf("Expected an error")
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected errors not to be cached, got %d calls", calls)
+	}
+}
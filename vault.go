@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+// ErrNoRefreshToken is returned when the vault has no refresh token for a
+// household
+var ErrNoRefreshToken = errors.New("access to Nest hasn't been authorized for the household")
+
+// vaultName is passed to securecookie when encrypting refresh tokens, so a
+// refresh token in the vault can't be passed off as a cookie, or vice versa
+const vaultName = "refresh-token"
+
+// Vault keeps refresh tokens encrypted at rest in the store, keyed by the ID of
+// the household sharing the refresh token.
+// Neither the cookie nor background jobs need to hold the refresh token, so
+// jobs can get access tokens without a browser.
+//
+// Tokens are encrypted with the first codec. The others are previous keys,
+// which tokens are re-encrypted from as they are read, or all at once by
+// Rotate.
+type Vault struct {
+	store  *Store
+	codecs []securecookie.Codec
+
+	// legacy maps refresh tokens imported from cookies from before the vault
+	// to their household, so each token only gets one household
+	legacyMu sync.Mutex
+	legacy   map[string]string
+}
+
+func NewVault(store *Store, codecs ...securecookie.Codec) *Vault {
+	for _, codec := range codecs {
+		// Tokens are kept until they're revoked, not for securecookie's 30 days
+		if secureCookie, ok := codec.(*securecookie.SecureCookie); ok {
+			secureCookie.MaxAge(0)
+		}
+	}
+	return &Vault{
+		store:  store,
+		codecs: codecs,
+		legacy: make(map[string]string),
+	}
+}
+
+// Put stores the refresh token for a household
+func (v *Vault) Put(householdID, refreshToken string) error {
+	encrypted, err := securecookie.EncodeMulti(vaultName, refreshToken, v.codecs[0])
+	if err != nil {
+		return fmt.Errorf("failed to encrypt refresh token: %w", err)
+	}
+	return v.store.PutSecret(householdID, encrypted)
+}
+
+// RefreshToken returns the refresh token for a household. A token encrypted with
+// a previous key is re-encrypted with the current one.
+func (v *Vault) RefreshToken(householdID string) (string, error) {
+	encrypted, ok := v.store.Secret(householdID)
+	if !ok {
+		return "", ErrNoRefreshToken
+	}
+	refreshToken, current, err := v.decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if !current {
+		if err := v.Put(householdID, refreshToken); err != nil {
+			log.Printf("Failed to re-encrypt refresh token for a household: %s", err)
+		}
+	}
+	return refreshToken, nil
+}
+
+// decrypt returns the refresh token, and whether it was encrypted with the
+// current key
+func (v *Vault) decrypt(encrypted string) (string, bool, error) {
+	var refreshToken string
+	if err := securecookie.DecodeMulti(vaultName, encrypted, &refreshToken, v.codecs[0]); err == nil {
+		return refreshToken, true, nil
+	}
+	if err := securecookie.DecodeMulti(vaultName, encrypted, &refreshToken, v.codecs[1:]...); err != nil {
+		return "", false, fmt.Errorf("failed to decrypt refresh token: %w", err)
+	}
+	return refreshToken, false, nil
+}
+
+// Has reports whether there is a refresh token for the household
+func (v *Vault) Has(householdID string) bool {
+	if householdID == "" {
+		return false
+	}
+	_, ok := v.store.Secret(householdID)
+	return ok
+}
+
+// Delete removes the refresh token for a household
+func (v *Vault) Delete(householdID string) error {
+	return v.store.DeleteSecret(householdID)
+}
+
+// Revoke removes a refresh token which Google has rejected, remembering that it
+// was revoked until a new one is put for the household
+func (v *Vault) Revoke(householdID string) error {
+	return v.store.RevokeSecret(householdID)
+}
+
+// Revoked reports whether the household's refresh token was revoked by Google,
+// and hasn't been replaced since
+func (v *Vault) Revoked(householdID string) bool {
+	return householdID != "" && v.store.Revoked(householdID)
+}
+
+// Rotate re-encrypts every refresh token encrypted with a previous key, so
+// that the previous key can be dropped. Tokens which can't be decrypted with
+// any key are left alone, in case the keys have been misconfigured.
+func (v *Vault) Rotate() error {
+	for householdID, encrypted := range v.store.Secrets() {
+		refreshToken, current, err := v.decrypt(encrypted)
+		if err != nil {
+			log.Printf("Unable to rotate the key for a household: %s", err)
+			continue
+		}
+		if current {
+			continue
+		}
+		if err := v.Put(householdID, refreshToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import moves a refresh token held in a cookie from before the vault into the
+// vault, returning the ID of the household it is kept for
+func (v *Vault) Import(refreshToken string) (string, error) {
+	v.legacyMu.Lock()
+	defer v.legacyMu.Unlock()
+	if householdID, ok := v.legacy[refreshToken]; ok {
+		return householdID, nil
+	}
+	householdID := newID()
+	if err := v.Put(householdID, refreshToken); err != nil {
+		return "", err
+	}
+	v.legacy[refreshToken] = householdID
+	return householdID, nil
+}
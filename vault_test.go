@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func newTestVault(t *testing.T, codecs ...securecookie.Codec) *Vault {
+	t.Helper()
+	testStore, err := OpenStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	return NewVault(testStore, codecs...)
+}
+
+func newTestCodec() securecookie.Codec {
+	return securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+}
+
+func TestVaultPut(t *testing.T) {
+	v := newTestVault(t, newTestCodec())
+	err := v.Put("household", "refresh-token")
+	if err != nil {
+		t.Fatalf("Failed to put refresh token: %s", err)
+	}
+	encrypted, _ := v.store.Secret("household")
+	if encrypted == "refresh-token" {
+		t.Errorf("Expected the refresh token to be encrypted")
+	}
+	refreshToken, err := v.RefreshToken("household")
+	if err != nil || refreshToken != "refresh-token" {
+		t.Errorf("Expected refresh-token, got %q %v", refreshToken, err)
+	}
+	if !v.Has("household") || v.Has("other") || v.Has("") {
+		t.Errorf("Expected only the stored household to be found")
+	}
+
+	v.Delete("household")
+	_, err = v.RefreshToken("household")
+	if !errors.Is(err, ErrNoRefreshToken) {
+		t.Errorf("Expected ErrNoRefreshToken, got %v", err)
+	}
+}
+
+func TestVaultRotate(t *testing.T) {
+	oldCodec, newCodec := newTestCodec(), newTestCodec()
+	v := newTestVault(t, oldCodec)
+	v.Put("household-1", "refresh-token-1")
+	v.Put("household-2", "refresh-token-2")
+
+	v = NewVault(v.store, newCodec, oldCodec)
+	refreshToken, err := v.RefreshToken("household-1")
+	if err != nil || refreshToken != "refresh-token-1" {
+		t.Fatalf("Expected refresh-token-1 using the previous key, got %q %v", refreshToken, err)
+	}
+	err = v.Rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate: %s", err)
+	}
+
+	// Both are readable once the previous key is dropped
+	v = NewVault(v.store, newCodec)
+	for householdID, expected := range map[string]string{"household-1": "refresh-token-1", "household-2": "refresh-token-2"} {
+		refreshToken, err := v.RefreshToken(householdID)
+		if err != nil || refreshToken != expected {
+			t.Errorf("Expected %s to be re-encrypted, got %q %v", householdID, refreshToken, err)
+		}
+	}
+}
+
+func TestVaultRotateUnknownKey(t *testing.T) {
+	v := newTestVault(t, newTestCodec())
+	v.Put("household", "refresh-token")
+
+	v = NewVault(v.store, newTestCodec())
+	err := v.Rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate: %s", err)
+	}
+	if !v.Has("household") {
+		t.Errorf("Expected a token which can't be decrypted to be left alone")
+	}
+}
+
+func TestVaultImport(t *testing.T) {
+	v := newTestVault(t, newTestCodec())
+	first, err := v.Import("refresh-token")
+	if err != nil {
+		t.Fatalf("Failed to import: %s", err)
+	}
+	second, _ := v.Import("refresh-token")
+	if first != second {
+		t.Errorf("Expected the same refresh token to get the same household, got %s and %s", first, second)
+	}
+	refreshToken, err := v.RefreshToken(first)
+	if err != nil || refreshToken != "refresh-token" {
+		t.Errorf("Expected refresh-token, got %q %v", refreshToken, err)
+	}
+}